@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -16,6 +17,14 @@ var (
 	output     string
 	gitbookUrl string
 	epubFile   string
+	layout     string
+	appendix   bool
+	hideNotes  bool
+	lists      bool
+	headingToc bool
+	splitAt    string
+	mergeSize  int64
+	tocFile    string
 )
 
 func init() {
@@ -23,10 +32,24 @@ func init() {
 	flag.StringVar(&output, "o", "output", "output directory, must be a not exist directory")
 	flag.StringVar(&gitbookUrl, "g", "", "gitbook library endpoint, like https://cdn.jim.plus/")
 	flag.StringVar(&epubFile, "e", "", "epub book path")
+	flag.StringVar(&layout, "layout", epub.LayoutFlat, "output layout, \"flat\" saves all pages into output directory and renames the duplicated ones, \"tree\" keeps the directory structure of book")
+	flag.BoolVar(&appendix, "appendix", false, "group non-linear pages missing in TOC under an \"Appendix\" node")
+	flag.BoolVar(&hideNotes, "hide-notes", false, "keep footnote and endnote pages out of TOC, notes are shown as popovers anyway")
+	flag.BoolVar(&lists, "lists", false, "build lists of illustrations, tables and audio from captioned figures and tables, when the book has none")
+	flag.BoolVar(&headingToc, "heading-toc", false, "build TOC from h1-h3 headings of chapters, for books without usable TOC")
+	flag.StringVar(&splitAt, "split-at", "", "split chapters into several pages, at \"h1\" or \"h2\" headings, or by \"size\"")
+	flag.Int64Var(&mergeSize, "merge-size", 0, "merge consecutive chapters smaller than this many bytes into one page, like the split files of calibre")
+	flag.StringVar(&tocFile, "toc-override", "", "YAML file renaming, hiding, moving, grouping and adding TOC entries, \"epub2website inspect -e book.epub\" prints one for the book")
 }
 
 func main() {
-	flag.Parse()
+	// "inspect" prints TOC of the book in the format of -toc-override, it takes the same flags
+	inspect := len(os.Args) > 1 && os.Args[1] == "inspect"
+	if inspect {
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
 	var err error
 	if workdir == "" {
 		workdir, err = ioutil.TempDir("/tmp", "epub2website-")
@@ -35,7 +58,8 @@ func main() {
 			panic(err)
 		}
 	}
-	if output == "" || epubFile == "" {
+	if output == "" || epubFile == "" || (layout != epub.LayoutFlat && layout != epub.LayoutTree) ||
+		(splitAt != "" && splitAt != epub.SplitH1 && splitAt != epub.SplitH2 && splitAt != epub.SplitSize) {
 		flag.Usage()
 		defer os.Exit(1)
 		return
@@ -50,9 +74,31 @@ func main() {
 		os.Exit(1)
 	}
 
-	firstPage, err := epub.Convert(output, workdir, gitbookUrl)
+	opts := epub.Options{
+		Layout:      layout,
+		Appendix:    appendix,
+		HideNotes:   hideNotes,
+		Lists:       lists,
+		HeadingToc:  headingToc,
+		SplitAt:     splitAt,
+		MergeSize:   mergeSize,
+		TocOverride: tocFile,
+	}
+	var firstPage string
+	if inspect {
+		err = epub.Inspect(os.Stdout, workdir, opts)
+	} else {
+		firstPage, err = epub.Convert(output, workdir, gitbookUrl, opts)
+	}
+	var encrypted *epub.ErrEncrypted
+	if errors.As(err, &encrypted) {
+		fmt.Fprintf(os.Stderr, "the book is protected by %s DRM and can not be converted\n", encrypted.Scheme)
+		os.Exit(2)
+	}
 	if err != nil {
 		panic(err)
 	}
-	fmt.Println(firstPage)
+	if !inspect {
+		fmt.Println(firstPage)
+	}
 }
@@ -0,0 +1,84 @@
+package epub
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	// url(x), url('x'), url("x")
+	cssUrlRegexp = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^)'"\s]*))\s*\)`)
+	// @import "x" and @import 'x', the url() form is handled by cssUrlRegexp
+	cssImportRegexp = regexp.MustCompile(`@import\s+(?:"([^"]*)"|'([^']*)')`)
+)
+
+// RewriteStyles rewrites url() and @import references in all book styles,
+// so they point to the place where the referenced assets are in the output directory.
+func (ncx *NCX) RewriteStyles() error {
+	for _, style := range ncx.Styles {
+		href := cleanHref(style.Href)
+		outPath, ok := ncx.assetPath(href)
+		if !ok {
+			continue
+		}
+		cssPath := path.Join(ncx.OutDir, outPath)
+		data, err := ioutil.ReadFile(cssPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "warnning: style %s not found\n", style.Href)
+				continue
+			}
+			return err
+		}
+		css := ncx.rewriteCss(string(data), href, outPath)
+		err = ioutil.WriteFile(cssPath, []byte(css), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteCss resolves references against cssHref in the manifest layout
+// and makes them relative to cssOut in the output layout
+func (ncx *NCX) rewriteCss(css, cssHref, cssOut string) string {
+	rewrite := func(ref string) string {
+		newRef, ok := ncx.ResolveAsset(cssHref, cssOut, ref)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "warnning: unresolved reference %s in style %s\n", ref, cssHref)
+		}
+		return newRef
+	}
+	css = replaceRefs(cssUrlRegexp, css, func(ref, quote string) string {
+		return fmt.Sprintf("url(%s%s%s)", quote, rewrite(ref), quote)
+	})
+	css = replaceRefs(cssImportRegexp, css, func(ref, quote string) string {
+		return fmt.Sprintf("@import %s%s%s", quote, rewrite(ref), quote)
+	})
+	return css
+}
+
+// replaceRefs calls fn with the reference and its quote of every match of re,
+// the first sub match is double quoted, the second one is single quoted and the third one is not quoted
+func replaceRefs(re *regexp.Regexp, css string, fn func(ref, quote string) string) string {
+	var buf strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(css, -1) {
+		buf.WriteString(css[last:m[0]])
+		switch {
+		case m[2] != -1:
+			buf.WriteString(fn(css[m[2]:m[3]], `"`))
+		case m[4] != -1:
+			buf.WriteString(fn(css[m[4]:m[5]], "'"))
+		default:
+			buf.WriteString(fn(css[m[6]:m[7]], ""))
+		}
+		last = m[1]
+	}
+	buf.WriteString(css[last:])
+	return buf.String()
+}
@@ -0,0 +1,102 @@
+package epub
+
+import (
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	// css rules, selector in the first sub match and declarations in the second one
+	cssRuleRegexp = regexp.MustCompile(`([^{}]*)\{([^{}]*)\}`)
+	// writing-mode, -epub-writing-mode and -webkit-writing-mode
+	cssWritingModeRegexp  = regexp.MustCompile(`(?:^|[;\s])(?:-epub-|-webkit-)?writing-mode\s*:\s*(vertical-rl|vertical-lr)`)
+	cssRootSelectorRegexp = regexp.MustCompile(`(?:^|[\s,>])(?:html|body)(?:$|[\s,.:#\[])`)
+)
+
+// languages written from right to left
+var rtlLanguages = map[string]bool{
+	"ar": true,
+	"dv": true,
+	"fa": true,
+	"he": true,
+	"iw": true,
+	"ps": true,
+	"sd": true,
+	"ug": true,
+	"ur": true,
+	"yi": true,
+}
+
+// isRTLLanguage reports whether the language tag, like "ar-EG", is written from right to left
+func isRTLLanguage(lang string) bool {
+	return rtlLanguages[strings.ToLower(strings.SplitN(strings.ReplaceAll(strings.TrimSpace(lang), "_", "-"), "-", 2)[0])]
+}
+
+// textDirection returns the direction of text in the language
+func textDirection(lang string) string {
+	if isRTLLanguage(lang) {
+		return "rtl"
+	}
+	return "ltr"
+}
+
+// initDirection reads the language, text direction, page progression direction and writing mode of the book.
+// Page progression only turns pages, vertical Japanese books progress from right to left with text of ltr direction.
+func (ncx *NCX) initDirection(opf *OPF) {
+	if len(opf.Languages) > 0 {
+		ncx.Language = strings.TrimSpace(opf.Languages[0])
+	}
+	ncx.Direction = textDirection(ncx.Language)
+	switch opf.Spine.PageProgressionDirection {
+	case "rtl", "ltr":
+		ncx.PageProgression = opf.Spine.PageProgressionDirection
+	default:
+		ncx.PageProgression = ncx.Direction
+	}
+
+	// kindle and some epub 2 books declare <meta name="primary-writing-mode" content="vertical-rl"/>
+	mode := opf.findMeta("primary-writing-mode")
+	if strings.HasPrefix(mode, "vertical") {
+		ncx.WritingMode = mode
+		return
+	}
+	// writing-mode of html and body in book styles would turn the whole theme vertical,
+	// so it is moved into the page content
+	for _, m := range opf.Manifests {
+		if m.MediaType != MediaTypeCSS {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(ncx.WorkDir, cleanHref(m.Href)))
+		if err != nil {
+			continue
+		}
+		if mode := findRootWritingMode(string(data)); mode != "" {
+			ncx.WritingMode = mode
+			return
+		}
+	}
+}
+
+// findRootWritingMode returns the vertical writing mode set on html or body
+func findRootWritingMode(css string) string {
+	for _, rule := range cssRuleRegexp.FindAllStringSubmatch(css, -1) {
+		if !cssRootSelectorRegexp.MatchString(strings.TrimSpace(rule[1])) {
+			continue
+		}
+		if m := cssWritingModeRegexp.FindStringSubmatch(rule[2]); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,254 @@
+package epub
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	AlgorithmIdpfFont  = "http://www.idpf.org/2008/embedding"
+	AlgorithmAdobeFont = "http://ns.adobe.com/pdf/enc#RC"
+)
+
+type Encryption struct {
+	EncryptedData []*EncryptedData `xml:"EncryptedData"`
+}
+
+type EncryptedData struct {
+	EncryptionMethod EncryptionMethod `xml:"EncryptionMethod"`
+	KeyInfo          *KeyInfo         `xml:"KeyInfo"`
+	CipherReference  CipherReference  `xml:"CipherData>CipherReference"`
+}
+
+type KeyInfo struct {
+	RetrievalMethod RetrievalMethod `xml:"RetrievalMethod"`
+	Inner           string          `xml:",innerxml"`
+}
+
+type RetrievalMethod struct {
+	URI string `xml:"URI,attr"`
+}
+
+type EncryptionMethod struct {
+	Algorithm string `xml:"Algorithm,attr"`
+}
+
+type CipherReference struct {
+	URI string `xml:"URI,attr"`
+}
+
+// isFontObfuscation reports whether the resource is only mangled by font obfuscation
+func (ed *EncryptedData) isFontObfuscation() bool {
+	switch ed.EncryptionMethod.Algorithm {
+	case AlgorithmIdpfFont, AlgorithmAdobeFont:
+		return true
+	}
+	return false
+}
+
+// Path returns the path of encrypted resource relative to the root of container
+func (ed *EncryptedData) Path() string {
+	uri, err := url.PathUnescape(ed.CipherReference.URI)
+	if err != nil {
+		uri = ed.CipherReference.URI
+	}
+	return path.Clean(strings.TrimPrefix(uri, "/"))
+}
+
+// LoadEncryption reads META-INF/encryption.xml, a nil Encryption is returned when the book has none
+func LoadEncryption(unzipDir string) (*Encryption, error) {
+	data, err := ioutil.ReadFile(path.Join(unzipDir, "META-INF", "encryption.xml"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	enc := &Encryption{}
+	err = xml.Unmarshal(data, enc)
+	if err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+// ErrEncrypted is returned when the content documents of a book are protected by DRM
+type ErrEncrypted struct {
+	Scheme string
+	// Path is the first encrypted content document
+	Path string
+}
+
+func (e *ErrEncrypted) Error() string {
+	return fmt.Sprintf("book is encrypted with %s DRM, %s can not be decoded", e.Scheme, e.Path)
+}
+
+const (
+	SchemeAdobeADEPT    = "Adobe ADEPT"
+	SchemeReadiumLCP    = "Readium LCP"
+	SchemeKobo          = "Kobo"
+	SchemeAppleFairPlay = "Apple FairPlay"
+	SchemeUnknown       = "unknown"
+)
+
+// CheckDRM returns an *ErrEncrypted when any content document of the book is encrypted
+func (enc *Encryption) CheckDRM(opf *OPF, opfDir, unzipDir string) error {
+	if enc == nil {
+		return nil
+	}
+	contents := make(map[string]bool)
+	for _, m := range opf.Manifests {
+		switch m.MediaType {
+		case MediaTypeHTML, MediaTypeNCX:
+			href, err := url.PathUnescape(m.Href)
+			if err != nil {
+				href = m.Href
+			}
+			contents[path.Join(opfDir, href)] = true
+		}
+	}
+	var encrypted *EncryptedData
+	for _, ed := range enc.EncryptedData {
+		if !ed.isFontObfuscation() && contents[ed.Path()] {
+			encrypted = ed
+			break
+		}
+	}
+	if encrypted == nil {
+		return nil
+	}
+	return &ErrEncrypted{
+		Scheme: detectScheme(enc, unzipDir),
+		Path:   encrypted.Path(),
+	}
+}
+
+func detectScheme(enc *Encryption, unzipDir string) string {
+	exists := func(name string) bool {
+		_, err := os.Stat(path.Join(unzipDir, "META-INF", name))
+		return err == nil
+	}
+	if exists("license.lcpl") {
+		return SchemeReadiumLCP
+	}
+	if exists("sinf.xml") {
+		return SchemeAppleFairPlay
+	}
+	if rights, err := ioutil.ReadFile(path.Join(unzipDir, "META-INF", "rights.xml")); err == nil {
+		if strings.Contains(string(rights), "http://ns.adobe.com/adept") {
+			return SchemeAdobeADEPT
+		}
+	}
+	hasKeyInfo := false
+	for _, ed := range enc.EncryptedData {
+		if ed.KeyInfo == nil {
+			continue
+		}
+		hasKeyInfo = true
+		if strings.Contains(ed.KeyInfo.RetrievalMethod.URI, "license.lcpl") {
+			return SchemeReadiumLCP
+		}
+		if strings.Contains(ed.KeyInfo.Inner, "http://ns.adobe.com/adept") {
+			return SchemeAdobeADEPT
+		}
+	}
+	// kobo keeps the keys in the database of device, so there is no key info in encryption.xml
+	if !hasKeyInfo && !exists("rights.xml") {
+		return SchemeKobo
+	}
+	return SchemeUnknown
+}
+
+// DeobfuscateFonts restores the fonts mangled with IDPF or Adobe font obfuscation,
+// outputDir holds the copy of opfDir which is relative to the root of container
+func (enc *Encryption) DeobfuscateFonts(opf *OPF, opfDir, outputDir string) error {
+	if enc == nil {
+		return nil
+	}
+	for _, ed := range enc.EncryptedData {
+		var key []byte
+		var length int
+		switch ed.EncryptionMethod.Algorithm {
+		case AlgorithmIdpfFont:
+			key = idpfFontKey(opf.findUniqueIdentifier())
+			length = 1040
+		case AlgorithmAdobeFont:
+			key = adobeFontKey(opf)
+			length = 1024
+		default:
+			fmt.Fprintf(os.Stderr, "warnning: can not decode %s, unsupported algorithm: %s\n", ed.Path(), ed.EncryptionMethod.Algorithm)
+			continue
+		}
+		if key == nil {
+			fmt.Fprintf(os.Stderr, "warnning: can not decode %s, no key found for algorithm: %s\n", ed.Path(), ed.EncryptionMethod.Algorithm)
+			continue
+		}
+		rel := ed.Path()
+		if opfDir != "." {
+			if !strings.HasPrefix(rel, opfDir+"/") {
+				fmt.Fprintf(os.Stderr, "warnning: can not decode %s, it is not in %s\n", rel, opfDir)
+				continue
+			}
+			rel = strings.TrimPrefix(rel, opfDir+"/")
+		}
+		fontPath := path.Join(outputDir, rel)
+		data, err := ioutil.ReadFile(fontPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warnning: can not decode %s: %s\n", ed.Path(), err)
+			continue
+		}
+		deobfuscate(data, key, length)
+		err = ioutil.WriteFile(fontPath, data, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deobfuscate xors the first length bytes of data with key
+func deobfuscate(data, key []byte, length int) {
+	for i := 0; i < length && i < len(data); i++ {
+		data[i] ^= key[i%len(key)]
+	}
+}
+
+// idpfFontKey is the SHA-1 digest of the unique identifier without white spaces
+func idpfFontKey(uid string) []byte {
+	uid = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, uid)
+	if uid == "" {
+		return nil
+	}
+	sum := sha1.Sum([]byte(uid))
+	return sum[:]
+}
+
+// adobeFontKey is the 16 bytes of the book uuid
+func adobeFontKey(opf *OPF) []byte {
+	ids := []string{opf.findUniqueIdentifier()}
+	for _, id := range opf.Identifiers {
+		ids = append(ids, id.Value)
+	}
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		id = strings.TrimPrefix(strings.ToLower(id), "urn:uuid:")
+		key, err := hex.DecodeString(strings.ReplaceAll(id, "-", ""))
+		if err == nil && len(key) == 16 {
+			return key
+		}
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package epub
 
 import (
 	"encoding/xml"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -9,45 +10,90 @@ import (
 	"github.com/otiai10/copy"
 )
 
-func Convert(outputDir, unzipDir, gitbookUrl string) (string, error) {
-	metaFile, err := os.OpenFile(path.Join(unzipDir, "META-INF", "container.xml"), os.O_RDONLY, 0644)
+func Convert(outputDir, unzipDir, gitbookUrl string, opts Options) (string, error) {
+	opf, rootFile, encryption, err := loadPackage(unzipDir)
+	if err != nil {
+		return "", err
+	}
+
+	err = copy.Copy(path.Join(unzipDir, path.Dir(rootFile)), outputDir)
+	if err != nil {
+		return "", err
+	}
+	err = encryption.DeobfuscateFonts(opf, path.Dir(rootFile), outputDir)
+	if err != nil {
+		return "", err
+	}
+	ncxPath := path.Join(unzipDir, path.Dir(rootFile), "toc.ncx")
+	ncx, err := NewNcx(ncxPath, outputDir, gitbookUrl, opf, opts)
 	if err != nil {
 		return "", err
 	}
+	err = ncx.RewriteStyles()
+	if err != nil {
+		return "", err
+	}
+	firstPage, err := ncx.Render()
+	if err != nil {
+		return "", err
+	}
+	ncx.BuildIndex()
+	err = ncx.WritePageList()
+	if err != nil {
+		return "", err
+	}
+	return firstPage.UpdateExt(firstPage.Src), nil
+}
+
+// Inspect writes TOC of the unzipped book to w in the format of TOC override, nothing is rendered
+func Inspect(w io.Writer, unzipDir string, opts Options) error {
+	opf, rootFile, _, err := loadPackage(unzipDir)
+	if err != nil {
+		return err
+	}
+	ncxPath := path.Join(unzipDir, path.Dir(rootFile), "toc.ncx")
+	ncx, err := NewNcx(ncxPath, "", "", opf, opts)
+	if err != nil {
+		return err
+	}
+	return ncx.WriteTocOverride(w)
+}
+
+// loadPackage reads OPF and encryption of the unzipped book, and checks DRM. The path of OPF is returned too.
+func loadPackage(unzipDir string) (*OPF, string, *Encryption, error) {
+	metaFile, err := os.OpenFile(path.Join(unzipDir, "META-INF", "container.xml"), os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, "", nil, err
+	}
 	metaData, _ := ioutil.ReadAll(metaFile)
 	metaInfo := &MetaInfo{}
 	err = xml.Unmarshal(metaData, metaInfo)
 	if err != nil {
-		return "", err
+		return nil, "", nil, err
 	}
 	//fmt.Printf("%#v\n", metaInfo)
 
 	opfFile, err := os.OpenFile(path.Join(unzipDir, metaInfo.RootFile.Path), os.O_RDONLY, 0644)
 	if err != nil {
-		return "", err
+		return nil, "", nil, err
 	}
 	opfData, _ := ioutil.ReadAll(opfFile)
 	opf := &OPF{}
 	err = xml.Unmarshal(opfData, opf)
 	opf.Dir = path.Dir(metaInfo.RootFile.Path)
 	if err != nil {
-		return "", err
+		return nil, "", nil, err
 	}
 	//fmt.Printf("%#v\n", opf)
 
-	err = copy.Copy(path.Join(unzipDir, path.Dir(metaInfo.RootFile.Path)), outputDir)
+	encryption, err := LoadEncryption(unzipDir)
 	if err != nil {
-		return "", err
+		return nil, "", nil, err
 	}
-	ncxPath := path.Join(unzipDir, path.Dir(metaInfo.RootFile.Path), "toc.ncx")
-	ncx, err := NewNcx(ncxPath, outputDir, gitbookUrl, opf)
+	err = encryption.CheckDRM(opf, path.Dir(metaInfo.RootFile.Path), unzipDir)
 	if err != nil {
-		return "", err
+		return nil, "", nil, err
 	}
-	firstPage, err := ncx.Render()
-	if err != nil {
-		return "", err
-	}
-	ncx.BuildIndex()
-	return firstPage.UpdateExt(firstPage.Src), nil
+
+	return opf, metaInfo.RootFile.Path, encryption, nil
 }
@@ -0,0 +1,267 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/jim3ma/epub2website"
+)
+
+const (
+	defaultViewportWidth  = 768
+	defaultViewportHeight = 1024
+)
+
+var (
+	viewportWidthRegexp  = regexp.MustCompile(`width\s*=\s*(\d+)`)
+	viewportHeightRegexp = regexp.MustCompile(`height\s*=\s*(\d+)`)
+)
+
+// FixedView is the data of fixed layout page template
+type FixedView struct {
+	Page *NavPoint
+	// Slots are the pages shown side by side from left to right, one or two for a spread
+	Slots []*FixedSlot
+	// Prev and Next are the neighbours when one page is shown
+	Prev string
+	Next string
+	// SpreadPrev and SpreadNext are the neighbours when the spread is shown
+	SpreadPrev string
+	SpreadNext string
+	// PageMap maps the urls of original documents to their pages
+	PageMap string
+}
+
+type FixedSlot struct {
+	Title   string
+	Src     string
+	Image   bool
+	Width   int
+	Height  int
+	Current bool
+}
+
+// initRendition reads the global layout and spread of the book
+func (ncx *NCX) initRendition(opf *OPF) {
+	ncx.FixedLayout = opf.findMeta("rendition:layout") == "pre-paginated"
+	ncx.Spread = opf.findMeta("rendition:spread") != "none"
+	ncx.viewport = opf.findMeta("rendition:viewport")
+}
+
+// isFixed reports whether the spine item is pre-paginated, item may be nil
+func (ncx *NCX) isFixed(item *ItemRef) bool {
+	if item != nil {
+		if item.hasProperty("rendition:layout-pre-paginated") {
+			return true
+		}
+		if item.hasProperty("rendition:layout-reflowable") {
+			return false
+		}
+	}
+	return ncx.FixedLayout
+}
+
+func (item *ItemRef) hasProperty(property string) bool {
+	for _, p := range strings.Fields(item.Properties) {
+		if p == property {
+			return true
+		}
+	}
+	return false
+}
+
+// spread returns "left", "right", "center" or an empty string
+func (np *NavPoint) spread() string {
+	if np.ItemRef == nil {
+		return ""
+	}
+	for _, side := range []string{"left", "right", "center"} {
+		if np.ItemRef.hasProperty("page-spread-"+side) || np.ItemRef.hasProperty("rendition:page-spread-"+side) {
+			return side
+		}
+	}
+	return ""
+}
+
+// spreadPartner returns the page shown with np on wide screens,
+// after reports whether the partner follows np in reading order
+func (np *NavPoint) spreadPartner() (partner *NavPoint, after bool) {
+	if !np.NCX.Spread {
+		return nil, false
+	}
+	first, second := "left", "right"
+	if np.NCX.PageProgression == "rtl" {
+		first, second = second, first
+	}
+	switch np.spread() {
+	case first:
+		if next := np.FindNextHtml(); next != nil && next.Fixed && next.spread() == second {
+			return next, true
+		}
+	case second:
+		if prev := np.FindPrevHtml(); prev != nil && prev.Fixed && prev.spread() == first {
+			return prev, false
+		}
+	}
+	return nil, false
+}
+
+func (np *NavPoint) RenderFixedPage(navi string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	pageFile, err := epub2website.Embed.Open("template/fixed.html")
+	if err != nil {
+		return nil, err
+	}
+	defer pageFile.Close()
+	page, err := ioutil.ReadAll(pageFile)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("fixed").Funcs(
+		template.FuncMap{
+			"href": np.Href,
+			"trim": np.TrimHash,
+			"rtl":  np.IsRTL,
+		},
+	).Parse(string(page))
+	if err != nil {
+		return nil, err
+	}
+	np.Navigation = navi
+	// the body is used by search index
+	err = np.loadHtml()
+	if err != nil {
+		return nil, err
+	}
+	view, err := np.fixedView()
+	if err != nil {
+		return nil, err
+	}
+	err = tmpl.Execute(&buf, view)
+	if err != nil {
+		return nil, err
+	}
+	ret := buf.Bytes()
+	np.save(ret)
+	return ret, nil
+}
+
+func (np *NavPoint) fixedView() (*FixedView, error) {
+	view := &FixedView{Page: np}
+	href := func(p *NavPoint) string {
+		if p == nil {
+			return ""
+		}
+		return np.TrimHash(np.Href(p))
+	}
+	current := np.fixedSlot(np)
+	current.Current = true
+	view.Slots = []*FixedSlot{current}
+	view.Prev, view.Next = href(np.FindPrevHtml()), href(np.FindNextHtml())
+	view.SpreadPrev, view.SpreadNext = view.Prev, view.Next
+	if partner, after := np.spreadPartner(); partner != nil {
+		slot := np.fixedSlot(partner)
+		// the following page is on the right in left to right books
+		if after == (np.NCX.PageProgression != "rtl") {
+			view.Slots = append(view.Slots, slot)
+		} else {
+			view.Slots = append([]*FixedSlot{slot}, view.Slots...)
+		}
+		if after {
+			view.SpreadNext = href(partner.FindNextHtml())
+		} else {
+			view.SpreadPrev = href(partner.FindPrevHtml())
+		}
+	}
+
+	pageMap := make(map[string]string)
+	for _, p := range np.NCX.pages() {
+		pageMap[relativeUrl(path.Dir(np.Src), cleanHref(p.HtmlPath))] = relativeUrl(path.Dir(np.Src), p.Src)
+	}
+	data, err := json.Marshal(pageMap)
+	if err != nil {
+		return nil, err
+	}
+	view.PageMap = string(data)
+	return view, nil
+}
+
+// fixedSlot shows the original document of p, which is kept in the output directory
+func (np *NavPoint) fixedSlot(p *NavPoint) *FixedSlot {
+	doc := cleanHref(p.HtmlPath)
+	slot := &FixedSlot{
+		Title: p.Title,
+		Src:   relativeUrl(path.Dir(np.Src), doc),
+		Image: isImage(np.NCX.mediaType(doc)),
+	}
+	slot.Width, slot.Height = np.NCX.findViewport(doc)
+	return slot
+}
+
+// findViewport reads the size of a fixed layout document from its viewport meta or svg viewBox
+func (ncx *NCX) findViewport(doc string) (width, height int) {
+	width, height = parseViewport(ncx.viewport)
+	if isImage(ncx.mediaType(doc)) && ncx.mediaType(doc) != MediaTypeImageSVG {
+		// the size of images is unknown, they are scaled by css
+		return
+	}
+	f, err := os.Open(path.Join(ncx.WorkDir, doc))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var d *goquery.Document
+	if ncx.mediaType(doc) == MediaTypeImageSVG {
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return
+		}
+		root, err := parseXML(data)
+		if err != nil {
+			return
+		}
+		d = goquery.NewDocumentFromNode(root)
+	} else if d, err = parseContent(f, ncx.mediaType(doc) == MediaTypeHTML, doc); err != nil {
+		return
+	}
+	if content, ok := d.Find(`meta[name="viewport"]`).First().Attr("content"); ok {
+		if w, h := parseViewport(content); w > 0 && h > 0 {
+			return w, h
+		}
+	}
+	if viewBox, ok := d.Find("svg").First().Attr("viewBox"); ok {
+		fields := strings.Fields(strings.ReplaceAll(viewBox, ",", " "))
+		if len(fields) == 4 {
+			w, _ := strconv.ParseFloat(fields[2], 64)
+			h, _ := strconv.ParseFloat(fields[3], 64)
+			if w > 0 && h > 0 {
+				return int(w), int(h)
+			}
+		}
+	}
+	return
+}
+
+// parseViewport parses "width=1200, height=1600"
+func parseViewport(content string) (width, height int) {
+	width, height = defaultViewportWidth, defaultViewportHeight
+	if m := viewportWidthRegexp.FindStringSubmatch(content); m != nil {
+		width, _ = strconv.Atoi(m[1])
+	}
+	if m := viewportHeightRegexp.FindStringSubmatch(content); m != nil {
+		height, _ = strconv.Atoi(m[1])
+	}
+	if width <= 0 || height <= 0 {
+		width, height = defaultViewportWidth, defaultViewportHeight
+	}
+	return
+}
@@ -0,0 +1,116 @@
+package epub
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// headings in TOC built by GenerateFromHeadings
+const headingSelector = "h1, h2, h3"
+
+// tocHeading is a heading of a content document with its stable id
+type tocHeading struct {
+	Rank  int
+	Id    string
+	Title string
+	s     *goquery.Selection
+}
+
+// GenerateFromHeadings builds a hierarchical TOC from h1-h3 headings of the linear spine items,
+// a heading is nested under the last heading of a higher rank. Documents without headings get one entry.
+// The levels are numbered by UpdateNavMap like other TOC.
+func (ncx *NCX) GenerateFromHeadings(opf *OPF) {
+	type level struct {
+		rank int
+		nav  *NavPoint
+	}
+	var stack []level
+	add := func(rank int, nav *NavPoint) {
+		for len(stack) > 0 && stack[len(stack)-1].rank >= rank {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			ncx.NavMap = append(ncx.NavMap, nav)
+		} else {
+			parent := stack[len(stack)-1].nav
+			parent.SubNavPoints = append(parent.SubNavPoints, nav)
+		}
+		stack = append(stack, level{rank: rank, nav: nav})
+	}
+	added := make(map[string]bool)
+	for _, item := range opf.Spine.ItemRefs {
+		mf := opf.findRenderable(opf.findManifestItem(item.Idref))
+		if mf == nil || !item.isLinear() || added[cleanHref(mf.Href)] {
+			continue
+		}
+		added[cleanHref(mf.Href)] = true
+		var headings []*tocHeading
+		if mf.MediaType == MediaTypeHTML || mf.MediaType == MediaTypeTextHTML {
+			if doc := ncx.contentDocument(cleanHref(mf.Href)); doc != nil {
+				headings = findHeadings(doc)
+			}
+		}
+		if len(headings) == 0 {
+			// a document without headings continues the chapter before it
+			nav := &NavPoint{
+				Title: ncx.findSpineTitle(mf, findTitle),
+				Content: content{
+					Src: mf.Href,
+				},
+			}
+			if len(stack) == 0 {
+				ncx.NavMap = append(ncx.NavMap, nav)
+			} else {
+				stack[0].nav.SubNavPoints = append(stack[0].nav.SubNavPoints, nav)
+			}
+			continue
+		}
+		for i, h := range headings {
+			src := mf.Href
+			// the first heading links to the page itself
+			if i > 0 {
+				src += (&url.URL{Fragment: h.Id}).String()
+			}
+			add(h.Rank, &NavPoint{
+				Title: h.Title,
+				Content: content{
+					Src: src,
+				},
+			})
+		}
+	}
+}
+
+// findHeadings returns the headings of doc in document order,
+// headings without id get a generated one, which is stable between parses of the same document
+func findHeadings(doc *goquery.Document) []*tocHeading {
+	var headings []*tocHeading
+	doc.Find("body").Find(headingSelector).Each(func(i int, s *goquery.Selection) {
+		title := strings.Join(strings.Fields(s.Text()), " ")
+		if title == "" {
+			return
+		}
+		id := s.AttrOr("id", "")
+		if id == "" {
+			id = fmt.Sprintf("epub-heading-%d", len(headings)+1)
+		}
+		rank := int(goquery.NodeName(s)[1] - '0')
+		headings = append(headings, &tocHeading{Rank: rank, Id: id, Title: title, s: s})
+	})
+	return headings
+}
+
+// markHeadings sets the generated ids of headings, like GenerateFromHeadings does
+func (ncx *NCX) markHeadings(doc *goquery.Document) {
+	if !ncx.Options.HeadingToc {
+		return
+	}
+	for _, h := range findHeadings(doc) {
+		if _, ok := h.s.Attr("id"); !ok {
+			h.s.SetAttr("id", h.Id)
+		}
+	}
+}
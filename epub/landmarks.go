@@ -0,0 +1,128 @@
+package epub
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// EPUB 2 guide types in the landmarks vocabulary of EPUB 3, the others keep their names
+var guideLandmarks = map[string]string{
+	"title-page":       "titlepage",
+	"text":             "bodymatter",
+	"acknowledgements": "acknowledgments",
+	"notes":            "endnotes",
+}
+
+// titles of landmarks without labels
+var landmarkTitles = map[string]string{
+	"cover":          "Cover",
+	"titlepage":      "Title Page",
+	"frontmatter":    "Front Matter",
+	"bodymatter":     "Start",
+	"backmatter":     "Back Matter",
+	"toc":            "Table of Contents",
+	"loi":            "List of Illustrations",
+	"lot":            "List of Tables",
+	"loa":            "List of Audio",
+	"lov":            "List of Video",
+	"copyright-page": "Copyright",
+	"endnotes":       "Notes",
+}
+
+// navDocument returns the EPUB 3 nav document and its directory relative to OPF, or nil
+func (ncx *NCX) navDocument(opf *OPF) (*NavDoc, string) {
+	nav := opf.findNavDoc()
+	if nav == nil {
+		return nil, ""
+	}
+	if ncx.navDoc == nil {
+		navDoc, err := LoadNavDoc(path.Join(ncx.WorkDir, nav.Href))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warnning: nav document %s is skipped: %s\n", nav.Href, err)
+			navDoc = &NavDoc{}
+		}
+		ncx.navDoc = navDoc
+	}
+	return ncx.navDoc, path.Dir(nav.Href)
+}
+
+// loadLandmarks reads the landmarks nav of EPUB 3, or the guide of EPUB 2
+func (ncx *NCX) loadLandmarks(opf *OPF) {
+	if navDoc, relPath := ncx.navDocument(opf); navDoc != nil {
+		if nav := navDoc.findNav("landmarks"); nav != nil && nav.Item != nil {
+			for _, item := range nav.Item.ItemInner {
+				ncx.addLandmark(item.Anchor.Type, innerText(item.Anchor.Title), path.Join(relPath, item.Anchor.Href))
+			}
+			return
+		}
+	}
+	for _, g := range opf.Guides {
+		landmark := strings.TrimPrefix(g.Type, "other.")
+		if t, ok := guideLandmarks[landmark]; ok {
+			landmark = t
+		}
+		ncx.addLandmark(landmark, g.Title, g.Href)
+	}
+}
+
+func (ncx *NCX) addLandmark(landmark, title, href string) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		title = landmarkTitle(landmark)
+	}
+	if title == "" || href == "" {
+		return
+	}
+	ncx.Landmarks = append(ncx.Landmarks, &NavPoint{
+		Title: title,
+		Content: content{
+			Src: href,
+		},
+		Landmark: landmark,
+	})
+}
+
+func landmarkTitle(landmark string) string {
+	if title, ok := landmarkTitles[landmark]; ok {
+		return title
+	}
+	words := strings.Fields(strings.ReplaceAll(landmark, "-", " "))
+	for i, w := range words {
+		words[i] = strings.ToUpper(w[:1]) + w[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+// initLandmarks sets up the paths of landmarks, it must be called after UpdateNavMap.
+// The landmarks out of TOC and spine, like a cover page, are rendered without navigation entries.
+func (ncx *NCX) initLandmarks() {
+	rendered := make(map[string]bool)
+	for _, np := range ncx.pages() {
+		rendered[cleanHref(np.HtmlPath)] = true
+	}
+	var landmarks []*NavPoint
+	for _, lm := range ncx.Landmarks {
+		ncx.initNavPoint(lm)
+		doc := cleanHref(lm.HtmlPath)
+		if !rendered[doc] {
+			mf, ok := ncx.manifestItems[doc]
+			if !ok || ncx.OPF.findRenderable(mf) == nil {
+				fmt.Fprintf(os.Stderr, "warnning: landmark %s (%s) is not a page of the book, skipped\n", lm.Title, lm.Content.Src)
+				continue
+			}
+			page := &NavPoint{
+				Title: lm.Title,
+				Content: content{
+					Src: trimSharp(lm.Content.Src),
+				},
+			}
+			ncx.initNavPoint(page)
+			ncx.Hidden = append(ncx.Hidden, page)
+			rendered[doc] = true
+		}
+		landmarks = append(landmarks, lm)
+	}
+	ncx.Landmarks = landmarks
+}
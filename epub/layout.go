@@ -0,0 +1,125 @@
+package epub
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// output layouts, pages with the same name get a numeric suffix in both of them
+const (
+	// LayoutFlat saves all pages into the root of output directory
+	LayoutFlat = "flat"
+	// LayoutTree keeps the directory structure of manifest
+	LayoutTree = "tree"
+)
+
+type Options struct {
+	// Layout is LayoutFlat or LayoutTree, default is LayoutFlat
+	Layout string
+	// Appendix groups the non-linear spine items missing in TOC under an "Appendix" node,
+	// otherwise they are rendered without navigation entries
+	Appendix bool
+	// HideNotes keeps the standalone footnote and endnote pages out of TOC, they are still rendered
+	HideNotes bool
+	// Lists builds the lists of illustrations, tables and audio from captioned figures and tables,
+	// when the nav document has none
+	Lists bool
+	// HeadingToc builds TOC from h1-h3 headings of spine items instead of the TOC of book
+	HeadingToc bool
+	// SplitAt splits spine items into several pages, at SplitH1 or SplitH2 headings, or by SplitSize.
+	// Empty keeps one page per spine item
+	SplitAt string
+	// MergeSize merges consecutive linear spine items smaller than MergeSize bytes into one page, 0 keeps them apart
+	MergeSize int64
+	// TocOverride is the YAML file renaming, hiding, moving, grouping and adding TOC entries, see TocOverride
+	TocOverride string
+}
+
+// buildPagePaths names the output page of every content document,
+// spine items are named first, so they keep the plain names when collisions occur
+func (ncx *NCX) buildPagePaths(opf *OPF) {
+	ncx.pagePaths = make(map[string]string)
+	ncx.pageNames = make(map[string]bool)
+	// the original documents of fixed layout pages are kept for the viewer
+	for key, item := range ncx.itemRefs {
+		if ncx.isFixed(item) {
+			ncx.pageNames[key] = true
+		}
+	}
+	for _, item := range opf.Spine.ItemRefs {
+		if mf := opf.findRenderable(opf.findManifestItem(item.Idref)); mf != nil {
+			ncx.pagePath(mf.Href)
+		}
+	}
+	for _, mf := range opf.Manifests {
+		if mf.MediaType == MediaTypeHTML {
+			ncx.pagePath(mf.Href)
+		}
+	}
+	// links to foreign documents go to the pages of their fallbacks
+	for _, mf := range opf.Manifests {
+		if rendered := opf.findRenderable(mf); rendered != nil && rendered != mf {
+			ncx.pagePaths[cleanHref(mf.Href)] = ncx.pagePath(rendered.Href)
+		}
+	}
+}
+
+// markRenderedPages records the rendered pages, it must be called after all pages are added.
+// Documents in manifest only, like the nav document, have page paths but no pages.
+func (ncx *NCX) markRenderedPages() {
+	ncx.renderedPages = make(map[string]bool)
+	for _, np := range ncx.pages() {
+		if !np.Group {
+			ncx.renderedPages[np.Src] = true
+		}
+	}
+}
+
+// isRendered reports whether the output page p is rendered, all pages are before markRenderedPages
+func (ncx *NCX) isRendered(p string) bool {
+	return ncx.renderedPages == nil || ncx.renderedPages[p]
+}
+
+// pagePath returns the path of output page for a content document,
+// href is relative to the directory of OPF and must not contain a fragment
+func (ncx *NCX) pagePath(href string) string {
+	key := cleanHref(href)
+	if p, ok := ncx.pagePaths[key]; ok {
+		return p
+	}
+	var name string
+	switch ncx.Options.Layout {
+	case LayoutTree:
+		name = ncx.pageFile(key)
+	default:
+		name = ncx.pageFile(path.Base(key))
+	}
+	p := ncx.reservePage(key, name)
+	ncx.pagePaths[key] = p
+	return p
+}
+
+// reservePage returns name, or name with a numeric suffix when it is in use, for the page of doc
+func (ncx *NCX) reservePage(doc, name string) string {
+	p := name
+	ext := path.Ext(name)
+	for i := 2; ncx.pageNames[p]; i++ {
+		p = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	if p != name {
+		fmt.Fprintf(os.Stderr, "warnning: page %s is renamed to %s to avoid collision\n", doc, p)
+	}
+	ncx.pageNames[p] = true
+	return p
+}
+
+// pageFile replaces the extension of a content document with ".html",
+// image spine items are wrapped with pages too
+func (ncx *NCX) pageFile(href string) string {
+	if isImage(ncx.mediaType(href)) {
+		return strings.TrimSuffix(href, path.Ext(href)) + ".html"
+	}
+	return updateExt(href)
+}
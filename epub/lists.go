@@ -0,0 +1,215 @@
+package epub
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// epub:type of the lists in nav documents: illustrations, tables and audio
+var listTypes = []string{"loi", "lot", "loa"}
+
+// listEntry is an entry of a list page, Title is inner xml and Href is relative to the directory of OPF
+type listEntry struct {
+	Title string
+	Href  string
+	Sub   []*listEntry
+}
+
+// listTarget is a captioned figure, table or audio found in a content document
+type listTarget struct {
+	Type    string
+	Id      string
+	Caption string
+	s       *goquery.Selection
+}
+
+// generatedList is a list page added by buildLists, its document is built in memory when it is read
+type generatedList struct {
+	Type    string
+	Title   string
+	Entries []*listEntry
+}
+
+// buildLists adds pages for the lists of nav document, or builds the lists from content with Options.Lists,
+// the pages are appended to TOC, nothing is written into the work directory
+func (ncx *NCX) buildLists(opf *OPF) {
+	navDoc, relPath := ncx.navDocument(opf)
+	for _, listType := range listTypes {
+		var entries []*listEntry
+		if navDoc != nil {
+			if nav := navDoc.findNav(listType); nav != nil && nav.Item != nil {
+				entries = buildListEntries(nav.Item, relPath)
+			}
+		}
+		if len(entries) == 0 && ncx.Options.Lists {
+			entries = ncx.scanList(opf, listType)
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		title := landmarkTitle(listType)
+		href := ncx.addList(listType, title, entries)
+		mf := &ManifestItem{Id: "epub2website-" + listType, Href: href, MediaType: MediaTypeHTML}
+		opf.Manifests = append(opf.Manifests, mf)
+		ncx.manifestItems[href] = mf
+		ncx.NavMap = append(ncx.NavMap, &NavPoint{
+			Title: title,
+			Content: content{
+				Src: href,
+			},
+		})
+	}
+}
+
+func buildListEntries(item *Item, relPath string) []*listEntry {
+	var entries []*listEntry
+	for _, inner := range item.ItemInner {
+		entry := &listEntry{Title: firstNonEmpty(inner.Anchor.Title, inner.Span.Title)}
+		if inner.Anchor.Href != "" {
+			entry.Href = path.Join(relPath, inner.Anchor.Href)
+		}
+		if inner.SubItem != nil {
+			entry.Sub = buildListEntries(inner.SubItem, relPath)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// scanList finds the targets of listType in content documents of spine
+func (ncx *NCX) scanList(opf *OPF, listType string) []*listEntry {
+	var entries []*listEntry
+	scanned := make(map[string]bool)
+	for _, item := range opf.Spine.ItemRefs {
+		mf := opf.findRenderable(opf.findManifestItem(item.Idref))
+		if mf == nil || scanned[cleanHref(mf.Href)] {
+			continue
+		}
+		scanned[cleanHref(mf.Href)] = true
+		if mf.MediaType != MediaTypeHTML && mf.MediaType != MediaTypeTextHTML {
+			continue
+		}
+		doc := ncx.contentDocument(cleanHref(mf.Href))
+		if doc == nil {
+			continue
+		}
+		for _, t := range listTargets(doc) {
+			if t.Type != listType {
+				continue
+			}
+			entries = append(entries, &listEntry{
+				Title: html.EscapeString(t.Caption),
+				Href:  mf.Href + (&url.URL{Fragment: t.Id}).String(),
+			})
+		}
+	}
+	return entries
+}
+
+// listTargets returns the captioned figures, tables, audio and images of doc in document order.
+// Targets without id get a generated one, which is stable between parses of the same document.
+func listTargets(doc *goquery.Document) []*listTarget {
+	var targets []*listTarget
+	counts := make(map[string]int)
+	doc.Find("body").Find("figure, table, img[title]").Each(func(i int, s *goquery.Selection) {
+		var listType, caption string
+		switch goquery.NodeName(s) {
+		case "figure":
+			caption = s.ChildrenFiltered("figcaption").First().Text()
+			switch {
+			case s.Find("table").Length() > 0:
+				listType = "lot"
+			case s.Find("audio").Length() > 0:
+				listType = "loa"
+			case s.Find("img, svg, picture, canvas, object").Length() > 0:
+				listType = "loi"
+			}
+		case "table":
+			// a table in a figure is listed by the figure
+			if s.ParentsFiltered("figure").Length() > 0 {
+				return
+			}
+			caption, listType = s.ChildrenFiltered("caption").First().Text(), "lot"
+		case "img":
+			if s.ParentsFiltered("figure").Length() > 0 {
+				return
+			}
+			caption, listType = s.AttrOr("title", ""), "loi"
+		}
+		caption = strings.Join(strings.Fields(caption), " ")
+		if listType == "" || caption == "" {
+			return
+		}
+		counts[listType]++
+		id := s.AttrOr("id", "")
+		if id == "" {
+			id = fmt.Sprintf("epub-%s-%d", listType, counts[listType])
+		}
+		targets = append(targets, &listTarget{Type: listType, Id: id, Caption: caption, s: s})
+	})
+	return targets
+}
+
+// markListTargets sets the generated ids of list targets, like scanList does
+func (ncx *NCX) markListTargets(doc *goquery.Document) {
+	if !ncx.Options.Lists {
+		return
+	}
+	for _, t := range listTargets(doc) {
+		if _, ok := t.s.Attr("id"); !ok {
+			t.s.SetAttr("id", t.Id)
+		}
+	}
+}
+
+// addList adds the page of a list in the directory of OPF, returns its href,
+// which is not used by the book, neither in manifest nor in the work directory
+func (ncx *NCX) addList(listType, title string, entries []*listEntry) string {
+	href := listType + ".xhtml"
+	for i := 2; ; i++ {
+		_, known := ncx.manifestItems[href]
+		if _, err := os.Stat(path.Join(ncx.WorkDir, href)); !known && os.IsNotExist(err) {
+			break
+		}
+		href = fmt.Sprintf("%s-%d.xhtml", listType, i)
+	}
+	if ncx.generatedLists == nil {
+		ncx.generatedLists = make(map[string]*generatedList)
+	}
+	ncx.generatedLists[href] = &generatedList{Type: listType, Title: title, Entries: entries}
+	return href
+}
+
+// document returns the XHTML of the list page
+func (l *generatedList) document() string {
+	var buf strings.Builder
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	buf.WriteString(`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">`)
+	fmt.Fprintf(&buf, `<head><title>%s</title></head><body>`, html.EscapeString(l.Title))
+	fmt.Fprintf(&buf, `<nav epub:type="%s"><h1>%s</h1>`, l.Type, html.EscapeString(l.Title))
+	writeListEntries(&buf, l.Entries)
+	buf.WriteString(`</nav></body></html>`)
+	return buf.String()
+}
+
+func writeListEntries(buf *strings.Builder, entries []*listEntry) {
+	buf.WriteString(`<ol>`)
+	for _, entry := range entries {
+		if entry.Href == "" {
+			fmt.Fprintf(buf, `<li><span>%s</span>`, entry.Title)
+		} else {
+			fmt.Fprintf(buf, `<li><a href="%s">%s</a>`, html.EscapeString(entry.Href), entry.Title)
+		}
+		if len(entry.Sub) > 0 {
+			writeListEntries(buf, entry.Sub)
+		}
+		buf.WriteString(`</li>`)
+	}
+	buf.WriteString(`</ol>`)
+}
@@ -0,0 +1,103 @@
+package epub
+
+import (
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+// annotation encodings of TeX in MathML semantics
+var texEncodings = map[string]bool{
+	"application/x-tex":   true,
+	"application/x-latex": true,
+	"text/x-tex":          true,
+	"TeX":                 true,
+	"LaTeX":               true,
+}
+
+// namespaces rendered by browsers, the epub:case requiring one of them is chosen
+var supportedNamespaces = map[string]bool{
+	nsMathML: true,
+	nsSVG:    true,
+}
+
+// mathAltText returns the alttext of math, or its TeX annotation
+func mathAltText(m *goquery.Selection) string {
+	if alt := strings.TrimSpace(m.AttrOr("alttext", "")); alt != "" {
+		return alt
+	}
+	var tex string
+	m.Find("annotation").EachWithBreak(func(i int, a *goquery.Selection) bool {
+		if texEncodings[a.AttrOr("encoding", "")] {
+			tex = strings.TrimSpace(a.Text())
+			return false
+		}
+		return true
+	})
+	return tex
+}
+
+// mathText returns the text of math for search, the tokens are separated by spaces
+func mathText(m *goquery.Selection) string {
+	if alt := mathAltText(m); alt != "" {
+		return alt
+	}
+	var tokens []string
+	m.Find("mi, mn, mo, ms, mtext").Each(func(i int, t *goquery.Selection) {
+		if text := strings.TrimSpace(t.Text()); text != "" {
+			tokens = append(tokens, text)
+		}
+	})
+	return strings.Join(tokens, " ")
+}
+
+// prepareMath resolves epub:switch and fills the missing alttext of math from its TeX annotation
+func prepareMath(doc *goquery.Document) {
+	resolveSwitches(doc)
+	doc.Find("math").Each(func(i int, m *goquery.Selection) {
+		if _, ok := m.Attr("alttext"); !ok {
+			if alt := mathAltText(m); alt != "" {
+				m.SetAttr("alttext", alt)
+			}
+		}
+	})
+}
+
+// resolveSwitches replaces epub:switch with its first supported epub:case, or its epub:default.
+// MathML keeps the default as a fallback, which is shown when the browser can not render MathML.
+func resolveSwitches(doc *goquery.Document) {
+	switches := doc.Find("*").FilterFunction(func(i int, s *goquery.Selection) bool {
+		return goquery.NodeName(s) == "epub:switch"
+	})
+	// nested switches are resolved first
+	for i := switches.Length() - 1; i >= 0; i-- {
+		sw := switches.Eq(i)
+		var chosen, def *goquery.Selection
+		sw.Children().Each(func(i int, c *goquery.Selection) {
+			switch goquery.NodeName(c) {
+			case "epub:case":
+				if chosen == nil && supportedNamespaces[c.AttrOr("required-namespace", "")] {
+					chosen = c
+				}
+			case "epub:default":
+				def = c
+			}
+		})
+		switch {
+		case chosen != nil && def != nil && chosen.AttrOr("required-namespace", "") == nsMathML:
+			wrapper := &html.Node{Type: html.ElementNode, Data: "span", Attr: []html.Attribute{{Key: "class", Val: "epub-math"}}}
+			fallback := &html.Node{Type: html.ElementNode, Data: "span", Attr: []html.Attribute{{Key: "class", Val: "epub-math-fallback"}}}
+			sw.BeforeNodes(wrapper)
+			w := sw.Prev()
+			w.AppendSelection(chosen.Contents())
+			w.AppendNodes(fallback)
+			w.Children().Last().AppendSelection(def.Contents())
+		case chosen != nil:
+			sw.BeforeSelection(chosen.Contents())
+		case def != nil:
+			sw.BeforeSelection(def.Contents())
+		}
+		sw.Remove()
+	}
+}
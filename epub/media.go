@@ -0,0 +1,85 @@
+package epub
+
+import (
+	"io"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+const (
+	MediaAudio = "audio"
+	MediaVideo = "video"
+)
+
+// isMedia reports whether the media type is audio or video
+func isMedia(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "audio/") || strings.HasPrefix(mediaType, "video/")
+}
+
+// pageMedia returns MediaVideo or MediaAudio when the content document href plays them, or an empty string.
+// The tags are scanned without building the tree, which is done once by rendering.
+func (ncx *NCX) pageMedia(href string) string {
+	if mt := ncx.mediaType(href); mt != MediaTypeHTML && mt != MediaTypeTextHTML {
+		return ""
+	}
+	if media, ok := ncx.pageMedias[href]; ok {
+		return media
+	}
+	media := ""
+	if f, err := ncx.openDocument(href); err == nil {
+		media = scanMedia(f)
+		f.Close()
+	}
+	if ncx.pageMedias == nil {
+		ncx.pageMedias = make(map[string]string)
+	}
+	ncx.pageMedias[href] = media
+	return media
+}
+
+// scanMedia returns MediaVideo when the document has a video tag, or MediaAudio when it has an audio tag
+func scanMedia(r io.Reader) string {
+	media := ""
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return media
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case MediaVideo:
+				return MediaVideo
+			case MediaAudio:
+				media = MediaAudio
+			}
+		}
+	}
+}
+
+// prepareMedia moves the src of audio and video into a source child, and sets the type of sources from manifest,
+// so browsers skip the formats they can not play. It must be called before links are rewritten.
+func (np *NavPoint) prepareMedia(doc *goquery.Document) {
+	docHref := cleanHref(np.HtmlPath)
+	doc.Find("audio[src], video[src]").Each(func(i int, s *goquery.Selection) {
+		src, _ := s.Attr("src")
+		s.RemoveAttr("src")
+		source := &html.Node{Type: html.ElementNode, Data: "source", Attr: []html.Attribute{{Key: "src", Val: src}}}
+		s.PrependNodes(source)
+	})
+	doc.Find("source[src]").Each(func(i int, s *goquery.Selection) {
+		if _, ok := s.Attr("type"); ok {
+			return
+		}
+		src, _ := s.Attr("src")
+		if isExternalRef(src) {
+			return
+		}
+		target, _ := resolveRef(docHref, src)
+		if mt := np.NCX.mediaType(target); isMedia(mt) {
+			s.SetAttr("type", mt)
+		}
+	})
+}
@@ -0,0 +1,198 @@
+package epub
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+// mergeGroup is a run of tiny spine items rendered as one page, Docs[0] is the document owning the page
+type mergeGroup struct {
+	Docs []string
+	// member -> id of the section holding it in the page
+	anchors map[string]string
+	// member -> id -> new id, for the ids used by the documents before it
+	ids map[string]map[string]string
+}
+
+// mergePages merges consecutive linear spine items smaller than Options.MergeSize into one page,
+// it must be called after splitPages. The documents must be in the same directory, so their relative links keep working.
+// Links to a merged document go to its section, the ids used by earlier documents of the page are renamed.
+func (ncx *NCX) mergePages(opf *OPF) {
+	ncx.mergeGroups = make(map[string]*mergeGroup)
+	if ncx.Options.MergeSize <= 0 {
+		return
+	}
+	var group []string
+	size := int64(0)
+	flush := func() {
+		if len(group) > 1 {
+			ncx.addMergeGroup(group)
+		}
+		group, size = nil, 0
+	}
+	seen := make(map[string]bool)
+	for _, item := range opf.Spine.ItemRefs {
+		mf := opf.findRenderable(opf.findManifestItem(item.Idref))
+		if mf == nil || seen[cleanHref(mf.Href)] {
+			continue
+		}
+		key := cleanHref(mf.Href)
+		seen[key] = true
+		info, err := os.Stat(path.Join(ncx.WorkDir, key))
+		if err != nil || !item.isLinear() || ncx.isFixed(ncx.itemRefs[key]) || len(ncx.splitParts[key]) > 0 ||
+			(mf.MediaType != MediaTypeHTML && mf.MediaType != MediaTypeTextHTML) || info.Size() >= ncx.Options.MergeSize {
+			flush()
+			continue
+		}
+		if len(group) > 0 && (size+info.Size() > ncx.Options.MergeSize || path.Dir(group[0]) != path.Dir(key)) {
+			flush()
+		}
+		group = append(group, key)
+		size += info.Size()
+	}
+	flush()
+}
+
+func (ncx *NCX) addMergeGroup(docs []string) {
+	g := &mergeGroup{
+		Docs:    docs,
+		anchors: make(map[string]string),
+		ids:     make(map[string]map[string]string),
+	}
+	used := make(map[string]bool)
+	for i, doc := range docs {
+		if i > 0 {
+			g.anchors[doc] = fmt.Sprintf("epub-merged-%d", i+1)
+			used[g.anchors[doc]] = true
+		}
+		parsed, err := ncx.parseDocument(doc)
+		if err != nil {
+			continue
+		}
+		ncx.markIds(parsed)
+		renamed := make(map[string]string)
+		var ids []string
+		parsed.Find("body [id]").Each(func(j int, s *goquery.Selection) {
+			id := s.AttrOr("id", "")
+			if used[id] {
+				renamed[id] = g.anchors[doc] + "-" + id
+			}
+			ids = append(ids, id)
+		})
+		for _, id := range ids {
+			used[id] = true
+		}
+		if len(renamed) > 0 {
+			g.ids[doc] = renamed
+		}
+	}
+	page := ncx.pagePath(docs[0])
+	for _, doc := range docs[1:] {
+		old := ncx.pagePath(doc)
+		// foreign documents with the member as fallback go to the page too
+		for key, p := range ncx.pagePaths {
+			if p == old {
+				ncx.pagePaths[key] = page
+			}
+		}
+		delete(ncx.pageNames, old)
+	}
+	for _, doc := range docs {
+		ncx.mergeGroups[doc] = g
+	}
+}
+
+// mergedHead returns the document owning the page of href, which is href itself unless it is merged into a page
+func (ncx *NCX) mergedHead(href string) string {
+	if g, ok := ncx.mergeGroups[cleanHref(href)]; ok {
+		return g.Docs[0]
+	}
+	return href
+}
+
+// pageDocs returns the content documents rendered into the page of href
+func (ncx *NCX) pageDocs(href string) []string {
+	if g, ok := ncx.mergeGroups[cleanHref(href)]; ok {
+		return g.Docs
+	}
+	return []string{cleanHref(href)}
+}
+
+// mergedTarget returns the id of element id of content document href in its page,
+// the top of a merged document, with an empty id, is its section
+func (ncx *NCX) mergedTarget(href, id string) string {
+	g, ok := ncx.mergeGroups[cleanHref(href)]
+	if !ok {
+		return id
+	}
+	if id == "" {
+		return g.anchors[cleanHref(href)]
+	}
+	if renamed, ok := g.ids[cleanHref(href)][id]; ok {
+		return renamed
+	}
+	return id
+}
+
+// mergedSuffix returns the suffix of a link to content document href, like "?x#y", for its page
+func (ncx *NCX) mergedSuffix(href, suffix string) string {
+	if _, ok := ncx.mergeGroups[cleanHref(href)]; !ok {
+		return suffix
+	}
+	id, err := url.PathUnescape(strings.TrimPrefix(fragment(suffix), "#"))
+	if err != nil {
+		return suffix
+	}
+	if target := ncx.mergedTarget(href, id); target != id {
+		return trimSharp(suffix) + (&url.URL{Fragment: target}).String()
+	}
+	return suffix
+}
+
+// mergeDocs appends the other documents of the page of np to doc, each in a section
+func (np *NavPoint) mergeDocs(doc *goquery.Document) {
+	g, ok := np.NCX.mergeGroups[cleanHref(np.HtmlPath)]
+	if !ok {
+		return
+	}
+	body := doc.Find("body").First()
+	for _, member := range g.Docs[1:] {
+		parsed, err := np.NCX.parseDocument(member)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warnning: %s is not merged into %s: %s\n", member, np.Src, err)
+			continue
+		}
+		np.NCX.markIds(parsed)
+		memberBody := parsed.Find("body").First()
+		// links in the member are resolved against it, not the document owning the page
+		base := (&url.URL{Path: path.Base(member)}).EscapedPath()
+		memberBody.Find(`a[href^="#"]`).Each(func(i int, a *goquery.Selection) {
+			a.SetAttr("href", base+a.AttrOr("href", ""))
+		})
+		for id, renamed := range g.ids[member] {
+			memberBody.Find("[id]").FilterFunction(func(i int, s *goquery.Selection) bool {
+				return s.AttrOr("id", "") == id
+			}).SetAttr("id", renamed)
+		}
+		section := &html.Node{Type: html.ElementNode, Data: "section", Attr: []html.Attribute{
+			{Key: "id", Val: g.anchors[member]},
+			{Key: "class", Val: "epub-merged"},
+		}}
+		for _, attr := range []string{"lang", "dir"} {
+			if v := firstNonEmpty(memberBody.AttrOr(attr, ""), parsed.Find("html").AttrOr(attr, "")); v != "" {
+				section.Attr = append(section.Attr, html.Attribute{Key: attr, Val: v})
+			}
+		}
+		for _, n := range memberBody.Contents().Nodes {
+			n.Parent.RemoveChild(n)
+			section.AppendChild(n)
+		}
+		body.AppendNodes(section)
+	}
+}
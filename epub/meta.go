@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"html"
 	"io/ioutil"
 	"net/url"
 	"os"
@@ -23,10 +24,17 @@ const (
 	MediaTypeImageJPEG = "image/jpeg"
 	MediaTypeImagePNG  = "image/png"
 	MediaTypeImageGIF  = "image/gif"
+	MediaTypeImageWebP = "image/webp"
+	MediaTypeImageSVG  = "image/svg+xml"
 	MediaTypeHTML      = "application/xhtml+xml"
+	MediaTypeTextHTML  = "text/html"
 	MediaTypeNCX       = "application/x-dtbncx+xml"
 )
 
+func isImage(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "image/")
+}
+
 type MetaInfo struct {
 	RootFile RootFile `xml:"rootfiles>rootfile"`
 }
@@ -36,10 +44,60 @@ type RootFile struct {
 }
 
 type OPF struct {
-	Manifests []*ManifestItem `xml:"manifest>item"`
-	Spine     []*ItemRef      `xml:"spine>itemref"`
-	Guides    []Guide         `xml:"guide>reference"`
-	Dir       string
+	UniqueIdentifier string          `xml:"unique-identifier,attr"`
+	Identifiers      []Identifier    `xml:"metadata>identifier"`
+	Languages        []string        `xml:"metadata>language"`
+	Metas            []Meta          `xml:"metadata>meta"`
+	Manifests        []*ManifestItem `xml:"manifest>item"`
+	Spine            Spine           `xml:"spine"`
+	Guides           []Guide         `xml:"guide>reference"`
+	Dir              string
+}
+
+// Meta is EPUB 2 <meta name="" content=""/> or EPUB 3 <meta property="">value</meta>
+type Meta struct {
+	Name     string `xml:"name,attr"`
+	Content  string `xml:"content,attr"`
+	Property string `xml:"property,attr"`
+	Refines  string `xml:"refines,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// findMeta returns the value of a global EPUB 3 property or EPUB 2 named meta
+func (opf *OPF) findMeta(name string) string {
+	for _, m := range opf.Metas {
+		if m.Property == name && m.Refines == "" {
+			return strings.TrimSpace(m.Value)
+		}
+		if m.Name == name {
+			return strings.TrimSpace(m.Content)
+		}
+	}
+	return ""
+}
+
+type Spine struct {
+	Toc                      string     `xml:"toc,attr"`
+	PageProgressionDirection string     `xml:"page-progression-direction,attr"`
+	ItemRefs                 []*ItemRef `xml:"itemref"`
+}
+
+type Identifier struct {
+	Id    string `xml:"id,attr"`
+	Value string `xml:",chardata"`
+}
+
+// findUniqueIdentifier returns the identifier referenced by unique-identifier attribute of package
+func (opf *OPF) findUniqueIdentifier() string {
+	for _, id := range opf.Identifiers {
+		if id.Id == opf.UniqueIdentifier {
+			return id.Value
+		}
+	}
+	if len(opf.Identifiers) > 0 {
+		return opf.Identifiers[0].Value
+	}
+	return ""
 }
 
 func (opf *OPF) findNavDoc() *ManifestItem {
@@ -52,7 +110,15 @@ func (opf *OPF) findNavDoc() *ManifestItem {
 }
 
 type ItemRef struct {
-	Idref string `xml:"idref,attr"`
+	Idref      string `xml:"idref,attr"`
+	Id         string `xml:"id,attr"`
+	Linear     string `xml:"linear,attr"`
+	Properties string `xml:"properties,attr"`
+}
+
+// isLinear reports whether the item is a part of default reading order
+func (item *ItemRef) isLinear() bool {
+	return item.Linear != "no"
 }
 
 type ManifestItem struct {
@@ -60,6 +126,14 @@ type ManifestItem struct {
 	Id         string `xml:"id,attr"`
 	MediaType  string `xml:"media-type,attr"`
 	Properties string `xml:"properties,attr"`
+	Fallback   string `xml:"fallback,attr"`
+	// MediaOverlay is the id of the SMIL document synchronized with this item
+	MediaOverlay string `xml:"media-overlay,attr"`
+}
+
+// isRenderable reports whether the item can be rendered as a page
+func (item *ManifestItem) isRenderable() bool {
+	return item.MediaType == MediaTypeHTML || item.MediaType == MediaTypeTextHTML || isImage(item.MediaType)
 }
 
 type Guide struct {
@@ -70,53 +144,132 @@ type Guide struct {
 
 type NCX struct {
 	NavMap     []*NavPoint     `xml:"navMap>navPoint"`
+	PageList   []*PageTarget   `xml:"pageList>pageTarget"`
+	Hidden     []*NavPoint     `xml:"-"` // rendered, but not in navigation
 	Guides     []Guide         `xml:"-"`
+	Landmarks  []*NavPoint     `xml:"-"` // EPUB 3 landmarks, or EPUB 2 guide
+	Report     *MergeReport    `xml:"-"` // discrepancies between TOC and spine
 	Styles     []*ManifestItem `xml:"-"`
 	Navigation string          `xml:"-"`
 	WorkDir    string          `xml:"-"`
 	OutDir     string          `xml:"-"`
 	GitbookUrl string          `xml:"-"`
+	OPF        *OPF            `xml:"-"`
+	Options    Options         `xml:"-"`
+
+	Language        string `xml:"-"` // dc:language
+	Direction       string `xml:"-"` // ltr or rtl, direction of text by the language
+	PageProgression string `xml:"-"` // ltr or rtl, page-progression-direction of spine for arrows and spreads
+	WritingMode     string `xml:"-"` // vertical-rl, vertical-lr or empty for horizontal
+	FixedLayout     bool   `xml:"-"` // rendition:layout is pre-paginated
+	Spread          bool   `xml:"-"` // rendition:spread is not none
+	ActiveClass     string `xml:"-"` // media:active-class, applied to the playing fragment
+
+	// rendition:viewport, deprecated in EPUB 3.1
+	viewport string
+
+	// manifest path -> manifest item
+	manifestItems map[string]*ManifestItem
+	// manifest path -> spine item
+	itemRefs map[string]*ItemRef
+	// manifest path -> output page path
+	pagePaths map[string]string
+	// manifest path -> parts of the content document split by Options.SplitAt
+	splitParts map[string][]*pagePart
+	// manifest path -> id -> index of the part holding it
+	splitIds map[string]map[string]int
+	// manifest path -> the group of documents merged into one page by Options.MergeSize
+	mergeGroups map[string]*mergeGroup
+	// levels shown in navigation, 0 shows all of them
+	tocDepth int
+	// tocNumbering shows level numbers before titles in navigation
+	tocNumbering bool
+	// output page paths in use
+	pageNames map[string]bool
+	// output pages rendered, links to the pages of other documents are not resolved, see markRenderedPages
+	renderedPages map[string]bool
+	// manifest path -> media overlay clips of the content document
+	overlays map[string][]*overlayClip
+	// linear pages in reading order
+	readingOrder []*NavPoint
+	// output page path -> index in readingOrder
+	readingIndex map[string]int
+	// EPUB 3 nav document, empty when it can not be read
+	navDoc *NavDoc
+	// manifest path -> page targets in the content document
+	pageTargets map[string][]*PageTarget
+	// manifest path -> parsed content document, nil when it can not be parsed
+	contentDocs map[string]*goquery.Document
+	// manifest path -> list page generated by buildLists
+	generatedLists map[string]*generatedList
+	// manifest path -> MediaVideo, MediaAudio or empty, see pageMedia
+	pageMedias map[string]string
 }
 
 type NavPoint struct {
 	Title        string      `xml:"navLabel>text"`
 	SubNavPoints []*NavPoint `xml:"navPoint"`
 	Content      content     `xml:"content"`
+	PlayOrder    int         `xml:"playOrder,attr"`
 
 	NCX      *NCX   `xml:"-"`
 	Depth    int    `xml:"-"`
 	Level    string `xml:"-"`
-	HtmlPath string `xml:"-"` // x/a.html
-	Src      string `xml:"-"` // a.html
+	HtmlPath string `xml:"-"` // x/a.xhtml
+	Src      string `xml:"-"` // a.html, or x/a.html in LayoutTree
 	SrcRaw   string `xml:"-"` // a.html#1
 	Dir      string `xml:"-"` // x
 
 	Next *NavPoint `xml:"-"`
 	Prev *NavPoint `xml:"-"`
 
+	ItemRef *ItemRef `xml:"-"`
+	// NonLinear pages are skipped by prev and next navigation
+	NonLinear bool `xml:"-"`
+	// Group is a navigation node without its own page, it links to the first sub nav
+	Group bool `xml:"-"`
+	// Fixed pages are pre-paginated, they are shown by a viewer
+	Fixed bool `xml:"-"`
+	// Media is MediaVideo or MediaAudio when the page plays them, it is shown in navigation
+	Media string `xml:"-"`
+
 	Navigation string `xml:"-"`
 
+	// Lang and Direction of the content document, fall back to the book
+	Lang      string `xml:"-"`
+	Direction string `xml:"-"`
+
 	// read from html
 	HeadLinks string `xml:"-"`
 	Body      string `xml:"-"`
-
-	from string
+	// Overlay is the json of media overlay clips, empty when the page has none
+	Overlay string `xml:"-"`
+	// Landmark is the epub:type of landmarks, like "cover" or "bodymatter"
+	Landmark string `xml:"-"`
+	// Part is the index of the page of a content document split by Options.SplitAt
+	Part int `xml:"-"`
 }
 
 type content struct {
 	Src string `xml:"src,attr"`
 }
 
-func NewNcx(ncxPath string, outDir string, gitbook string, opf *OPF) (*NCX, error) {
+func NewNcx(ncxPath string, outDir string, gitbook string, opf *OPF, opts Options) (*NCX, error) {
 	ncx := &NCX{}
 	ncx.WorkDir = path.Dir(ncxPath)
+	ncx.Options = opts
+	ncx.indexManifest(opf)
 
 	// generate a ncx file from opf spine section
-	if _, err := os.Stat(ncxPath); os.IsNotExist(err) {
+	if opts.HeadingToc {
+		ncx.GenerateFromHeadings(opf)
+	} else if _, err := os.Stat(ncxPath); os.IsNotExist(err) {
 		// search TOC in OPF first
-		if nav := opf.findNavDoc(); nav != nil {
-			navDoc := LoadNavDoc(path.Join(ncx.WorkDir, nav.Href))
-			ncx.GenerateFromNavDoc(navDoc, path.Dir(nav.Href))
+		if navDoc, relPath := ncx.navDocument(opf); navDoc != nil {
+			if err := ncx.GenerateFromNavDoc(navDoc, relPath); err != nil {
+				fmt.Fprintf(os.Stderr, "warnning: TOC is built from spine: %s\n", err)
+				ncx.GenerateFromSpine(opf)
+			}
 		} else {
 			// Finally, we have no choose, read spine from OPF
 			ncx.GenerateFromSpine(opf)
@@ -131,6 +284,14 @@ func NewNcx(ncxPath string, outDir string, gitbook string, opf *OPF) (*NCX, erro
 		if err != nil {
 			return nil, err
 		}
+		sortByPlayOrder(ncx.NavMap)
+	}
+	if opts.TocOverride != "" {
+		override, err := LoadTocOverride(opts.TocOverride)
+		if err != nil {
+			return nil, err
+		}
+		ncx.applyTocOverride(opf, override)
 	}
 
 	for _, m := range opf.Manifests {
@@ -139,97 +300,112 @@ func NewNcx(ncxPath string, outDir string, gitbook string, opf *OPF) (*NCX, erro
 		}
 	}
 
+	ncx.OPF = opf
+	ncx.initDirection(opf)
+	ncx.initRendition(opf)
 	ncx.OutDir = outDir
 	ncx.GitbookUrl = strings.TrimRight(gitbook, "/")
 
-	var cover *NavPoint
-	for _, g := range opf.Guides {
-		href := g.Href
-		title := g.Title
-		if title == "" {
-			ext := path.Ext(g.Href)
-			title = strings.Replace(path.Base(g.Href), ext, "", 0)
-		}
-		if findSubNav(ncx.NavMap, href) {
-			continue
-		}
-		nav := &NavPoint{
-			Title: title,
-			Content: content{
-				Src: href,
-			},
-			from: "guide",
-		}
-		// TODO fix mismatch url in cover when cover is not in the directory which content in.
-		if g.Type == "cover" {
-			cover = nav
-			continue
-		}
-		ncx.NavMap = append([]*NavPoint{nav}, ncx.NavMap...)
-	}
-
-	if cover != nil {
-		ncx.NavMap = append([]*NavPoint{cover}, ncx.NavMap...)
-	}
-
 	// merge spine into NcxMap for avoiding missing some pages
 	// TODO find right Title in the missing pages
 	ncx.MergeSpine(opf)
 
+	ncx.buildLists(opf)
+	ncx.loadOverlays(opf)
+	ncx.buildPagePaths(opf)
+	ncx.splitPages(opf)
+	ncx.mergePages(opf)
+	ncx.loadPageList(opf)
+	ncx.initPageList()
+	ncx.loadLandmarks(opf)
+	if ncx.Options.HideNotes {
+		ncx.hideNotesPages()
+	}
 	ncx.UpdateNavMap()
+	ncx.addSplitParts()
+	ncx.initLandmarks()
+	ncx.buildReadingOrder(opf)
+	ncx.markRenderedPages()
+	// pages parse their own documents, the cached ones are not kept for the whole rendering
+	ncx.contentDocs = nil
 
 	return ncx, nil
 }
 
-func (ncx *NCX) GenerateFromNavDoc(navDoc *NavDoc, relPath string) {
-	var nav *Nav
-	for _, v := range navDoc.Body.Nav {
-		if v.Type == "toc" {
-			nav = v
-		}
-	}
+// GenerateFromNavDoc builds TOC from the toc nav of nav document, it fails when the nav is missing or empty
+func (ncx *NCX) GenerateFromNavDoc(navDoc *NavDoc, relPath string) error {
+	nav := navDoc.findNav("toc")
 	if nav == nil {
-		for _, v := range navDoc.Body.Section.Nav {
-			if v.Type == "toc" {
-				nav = v
-			}
+		return fmt.Errorf("toc nav is not found in nav document")
+	}
+	var hidden []*NavPoint
+	navs := buildNavPoints(nav.Item, relPath, false, &hidden)
+	if len(navs) == 0 {
+		return fmt.Errorf("toc nav of nav document is empty")
+	}
+	ncx.NavMap = navs
+	// hidden entries are rendered without navigation, unless their documents are in navigation already
+	cacheMap := make(map[string]*NavPoint)
+	buildCacheMap(cacheMap, ncx.NavMap)
+	for _, np := range hidden {
+		key := cacheKey(np.Content.Src)
+		if _, ok := cacheMap[key]; ok {
+			continue
 		}
+		cacheMap[key] = np
+		ncx.Hidden = append(ncx.Hidden, np)
 	}
-	if nav == nil {
-		panic("error nav doc")
+	return nil
+}
+
+// buildNavPoints builds the nav points of a list, hidden entries are collected into hiddenNavs without sub entries
+func buildNavPoints(item *Item, relPath string, hidden bool, hiddenNavs *[]*NavPoint) []*NavPoint {
+	if item == nil {
+		return nil
 	}
-	for _, item := range nav.Item.ItemInner {
-		np := buildNavPointFromNavItem(item, relPath)
-		ncx.NavMap = append(ncx.NavMap, np)
+	hidden = hidden || item.Hidden != nil
+	var nps []*NavPoint
+	for _, inner := range item.ItemInner {
+		if np := buildNavPointFromNavItem(inner, relPath, hidden, hiddenNavs); np != nil {
+			nps = append(nps, np)
+		}
 	}
+	return nps
 }
 
-func buildNavPointFromNavItem(item *ItemInner, relPath string) (np *NavPoint) {
+func buildNavPointFromNavItem(item *ItemInner, relPath string, hidden bool, hiddenNavs *[]*NavPoint) (np *NavPoint) {
+	hidden = hidden || item.Hidden != nil
 	np = &NavPoint{
-		Title: item.Anchor.Title,
-		Content: content{
-			Src: path.Join(relPath, item.Anchor.Href),
-		},
+		Title: firstNonEmpty(item.Anchor.Title, item.Span.Title),
 	}
-	if item.SubItem == nil {
-		return
+	subs := buildNavPoints(item.SubItem, relPath, hidden, hiddenNavs)
+	if item.Anchor.Href != "" {
+		np.Content.Src = path.Join(relPath, item.Anchor.Href)
+		if hidden {
+			*hiddenNavs = append(*hiddenNavs, np)
+			return nil
+		}
+		np.SubNavPoints = subs
+		return np
 	}
-	for _, sub := range item.SubItem.ItemInner {
-		subnp := buildNavPointFromNavItem(sub, relPath)
-		np.SubNavPoints = append(np.SubNavPoints, subnp)
+	// a heading without link groups its sub entries, and links to the first of them
+	if hidden || len(subs) == 0 {
+		return nil
 	}
-	return
+	np.SubNavPoints = subs
+	np.Content.Src = subs[0].Content.Src
+	np.Group = true
+	return np
 }
 
 func (ncx *NCX) GenerateFromSpine(opf *OPF) {
-	for _, item := range opf.Spine {
-		mf := opf.findManifestItem(item.Idref)
+	for _, item := range opf.Spine.ItemRefs {
+		mf := opf.findRenderable(opf.findManifestItem(item.Idref))
 		if mf == nil {
 			continue
 		}
-		htmlPath := path.Join(ncx.WorkDir, mf.Href)
 		np := &NavPoint{
-			Title: findTitle(htmlPath),
+			Title: ncx.findSpineTitle(mf, findTitle),
 			Content: content{
 				Src: mf.Href,
 			},
@@ -241,10 +417,7 @@ func (ncx *NCX) GenerateFromSpine(opf *OPF) {
 // build a clean map with trim # after html
 func buildCacheMap(npMap map[string]*NavPoint, nps []*NavPoint) {
 	for _, nav := range nps {
-		key, err := url.QueryUnescape(trimSharp(nav.Content.Src))
-		if err != nil {
-			key = trimSharp(nav.Content.Src)
-		}
+		key := cacheKey(nav.Content.Src)
 		//fmt.Println(key)
 		npMap[key] = nav
 		if len(nav.SubNavPoints) > 0 {
@@ -253,6 +426,20 @@ func buildCacheMap(npMap map[string]*NavPoint, nps []*NavPoint) {
 	}
 }
 
+// cacheKey returns the unescaped document of src
+func cacheKey(src string) string {
+	key, err := url.QueryUnescape(trimSharp(src))
+	if err != nil {
+		return trimSharp(src)
+	}
+	return key
+}
+
+// fragment returns the fragment of s with "#", or an empty string
+func fragment(s string) string {
+	return s[len(trimSharp(s)):]
+}
+
 func trimSharp(s string) string {
 	sharpIdx := strings.Index(s, "#")
 	if sharpIdx == -1 {
@@ -262,164 +449,58 @@ func trimSharp(s string) string {
 	}
 }
 
-func findSubNav(sub []*NavPoint, src string) bool {
-	for _, nav := range sub {
-		if trimSharp(nav.Content.Src) == trimSharp(src) {
-			return true
-		}
-		if len(nav.SubNavPoints) > 0 {
-			return findSubNav(nav.SubNavPoints, src)
-		}
+// findSpineTitle finds the title of spine item mf, find is used for content documents of any extension.
+// Other items, and documents without a title, are titled by their base names.
+func (ncx *NCX) findSpineTitle(mf *ManifestItem, find func(*goquery.Document) string) string {
+	if mf.MediaType != MediaTypeHTML && mf.MediaType != MediaTypeTextHTML {
+		return strings.TrimSuffix(path.Base(mf.Href), path.Ext(mf.Href))
 	}
-	return false
-}
-
-func (ncx *NCX) MergeSpine(opf *OPF) {
-	// cacheMap is used for check whether the page is processed
-	cacheMap := make(map[string]*NavPoint)
-	// rawMap is used for quick check whether the spine page is in ncx map
-	rawMap := make(map[string]*NavPoint)
-
-	buildCacheMap(cacheMap, ncx.NavMap)
-	buildCacheMap(rawMap, ncx.NavMap)
-	findPrevNav := func(idx int) *NavPoint {
-		for i := idx - 1; i >= 0; i-- {
-			mf := opf.findManifestItem(opf.Spine[i].Idref)
-			if mf == nil {
-				continue
-			}
-			trimPath, err := url.QueryUnescape(trimSharp(mf.Href))
-			if err != nil {
-				trimPath = mf.Href
-			}
-			if nav, ok := rawMap[trimPath]; ok {
-				/*
-					if nav.SubNavPoints != nil {
-						// find last sub nav
-						return FindLastSubNav(nav)
-					}
-				*/
-				return nav
-			}
-		}
-		return nil
+	doc := ncx.contentDocument(cleanHref(mf.Href))
+	if doc == nil {
+		return untitled(mf.Href, fmt.Errorf("it can not be read"))
 	}
-	for idx, item := range opf.Spine {
-		mf := opf.findManifestItem(item.Idref)
-		if mf == nil {
-			continue
-		}
-		htmlPath := path.Join(ncx.WorkDir, mf.Href)
-		// check src in NcxMap
-		trimPath, err := url.QueryUnescape(trimSharp(mf.Href))
-		if err != nil {
-			trimPath = trimSharp(mf.Href)
-		}
-		old, ok := cacheMap[trimPath]
-		// not in cacheMap
-		if old == nil && !ok {
-			//fmt.Printf("jim debug: page %s not found\n", mf.Href)
-			nav := &NavPoint{
-				// Spine page may not contain right title, try to find from H1, H2, H3 tag
-				Title: findHTitle(htmlPath),
-				Content: content{
-					Src: mf.Href,
-				},
-			}
-			if idx == 0 {
-				cacheMap[trimSharp(nav.Content.Src)] = nav
-				ncx.NavMap = append([]*NavPoint{nav}, ncx.NavMap...)
-			} else {
-				// find the first pre page which in rawMap and in cacheMap
-				pre := findPrevNav(idx)
-				if pre != nil {
-					cacheMap[trimSharp(nav.Content.Src)] = nav
-					pre.SubNavPoints = append(pre.SubNavPoints, nav)
-				} else {
-					panic("may be a bug, please report the trace to majinjing3@gmail.com")
-					//fmt.Printf("jim debug: prev page %s not found\n", mf2.Href)
-				}
-			}
-		}
+	title := strings.Join(strings.Fields(find(doc)), " ")
+	if title == "" || len(title) > 128 {
+		return strings.TrimSuffix(path.Base(mf.Href), path.Ext(mf.Href))
 	}
+	return title
 }
 
-func findHTitle(htmlPath string) (title string) {
-	htmlFile, err := os.OpenFile(htmlPath, os.O_RDONLY, 0644)
-	if err != nil {
-		panic(err)
-	}
-	defer htmlFile.Close()
-	ext := path.Ext(htmlPath)
-	switch ext {
-	case ".xhtml":
-		data, err := ioutil.ReadAll(htmlFile)
-		if err != nil {
-			panic(err)
-		}
-		x := xhtml{}
-		d := xml.NewDecoder(bytes.NewReader(data))
-		d.Strict = false
-		err = d.Decode(&x)
-		if err != nil {
-			panic(err)
-		}
-		title = x.Title
-	case ".html":
-		doc, err := goquery.NewDocumentFromReader(htmlFile)
-		if err != nil {
-			panic(err)
-		}
-		title = doc.Find("h1").Text()
-		if len(title) > 128 {
-			title = path.Base(htmlPath)
+// findHTitle finds the title of a content document from its first h1, h2 or h3, or its title element
+func findHTitle(doc *goquery.Document) string {
+	for _, h := range []string{"h1", "h2", "h3"} {
+		if title := strings.TrimSpace(doc.Find("body " + h).First().Text()); title != "" {
+			return title
 		}
-		if title == "" {
-			title = doc.Find("h2").Text()
-		}
-		if title == "" {
-			title = doc.Find("h3").Text()
-		}
-	default:
-		panic(fmt.Sprintf("unsupported file type: %s", htmlPath))
 	}
-	return
+	return findTitle(doc)
 }
 
-func findTitle(htmlPath string) (title string) {
-	htmlFile, err := os.OpenFile(htmlPath, os.O_RDONLY, 0644)
-	if err != nil {
-		panic(err)
-	}
-	defer htmlFile.Close()
-	ext := path.Ext(htmlPath)
-	switch ext {
-	case ".xhtml":
-		data, err := ioutil.ReadAll(htmlFile)
-		if err != nil {
-			panic(err)
-		}
-		x := xhtml{}
-		d := xml.NewDecoder(bytes.NewReader(data))
-		d.Strict = false
-		err = d.Decode(&x)
-		if err != nil {
-			panic(err)
-		}
-		title = x.Title
-	case ".html":
-		doc, err := goquery.NewDocumentFromReader(htmlFile)
-		if err != nil {
-			panic(err)
+// findTitle finds the title of a content document from its title element
+func findTitle(doc *goquery.Document) string {
+	return doc.Find("title").First().Text()
+}
+
+// untitled warns that the title of htmlPath is not found, and returns its base name as the title
+func untitled(htmlPath string, err error) string {
+	fmt.Fprintf(os.Stderr, "warnning: title of %s is not found: %s\n", htmlPath, err)
+	return strings.TrimSuffix(path.Base(htmlPath), path.Ext(htmlPath))
+}
+
+// findRenderable follows the fallback chain of item, and returns the first renderable item
+func (opf *OPF) findRenderable(item *ManifestItem) *ManifestItem {
+	visited := make(map[*ManifestItem]bool)
+	for item != nil && !visited[item] {
+		if item.isRenderable() {
+			return item
 		}
-		title = doc.Find("title").Text()
-		if len(title) > 128 {
-			title = path.Base(htmlPath)
+		visited[item] = true
+		if item.Fallback == "" {
+			return nil
 		}
-	default:
-		panic(fmt.Sprintf("unsupported file type: %s", htmlPath))
+		item = opf.findManifestItem(item.Fallback)
 	}
-	return
+	return nil
 }
 
 func (opf *OPF) findManifestItem(id string) *ManifestItem {
@@ -432,35 +513,77 @@ func (opf *OPF) findManifestItem(id string) *ManifestItem {
 }
 
 func (ncx *NCX) Render() (first *NavPoint, err error) {
-	navPoint := FindLastSubNav(ncx.NavMap[len(ncx.NavMap)-1])
 	first = ncx.NavMap[0]
-	navi, err := ncx.RenderNavigation(navPoint)
-	// 逆序打印，这样每一页的标题会是第一个指向该页面的标题
-	for navPoint != nil {
-		if err != nil {
-			return nil, err
+	// links in navigation are relative, pages in the same directory share one navigation
+	navis := make(map[string]string)
+	// 每一页只渲染一次，标题是第一个指向该页面的标题，其余的是页内链接
+	rendered := make(map[string]bool)
+	for _, np := range ncx.pages() {
+		if rendered[np.Src] {
+			continue
 		}
-		_, err = navPoint.RenderPage(navi)
+		rendered[np.Src] = true
+		err = ncx.renderPage(np, navis)
 		if err != nil {
 			return nil, err
 		}
-		navPoint = navPoint.Prev
 	}
 	return first, nil
 }
 
+func (ncx *NCX) renderPage(np *NavPoint, navis map[string]string) error {
+	if np.Group {
+		return nil
+	}
+	dir := path.Dir(np.Src)
+	navi, ok := navis[dir]
+	if !ok {
+		var err error
+		navi, err = ncx.RenderNavigation(np)
+		if err != nil {
+			return err
+		}
+		navis[dir] = navi
+	}
+	var err error
+	if np.Fixed {
+		_, err = np.RenderFixedPage(navi)
+	} else {
+		_, err = np.RenderPage(navi)
+	}
+	return err
+}
+
 type DocIndex struct {
 	Url      string `json:"url"`
 	Title    string `json:"title"`
 	Keywords string `json:"keywords"`
 	Body     string `json:"body"`
+	// Pages are the page breaks of print edition in Body, search results show the page of keyword
+	Pages []*PageOffset `json:"pages,omitempty"`
+}
+
+// HasOverlays reports whether any page of the book has a media overlay
+func (ncx *NCX) HasOverlays() bool {
+	return len(ncx.overlays) > 0
+}
+
+// pages returns all rendered nav points in reading order, followed by the hidden ones
+func (ncx *NCX) pages() []*NavPoint {
+	var pages []*NavPoint
+	for navPoint := ncx.NavMap[0]; navPoint != nil; navPoint = navPoint.Next {
+		if !navPoint.Group {
+			pages = append(pages, navPoint)
+		}
+	}
+	return append(pages, ncx.Hidden...)
 }
 
 func (ncx *NCX) BuildIndex() (err error) {
-	navPoint := ncx.NavMap[0]
+	pages := ncx.pages()
 	indexs := make(map[string]*DocIndex)
 	indexed := make(map[string]string)
-	for ; navPoint != nil; navPoint = navPoint.Next {
+	for _, navPoint := range pages {
 		if _, ok := indexed[navPoint.Src]; ok {
 			continue
 		}
@@ -472,12 +595,19 @@ func (ncx *NCX) BuildIndex() (err error) {
 		if err != nil {
 			panic(err)
 		}
+		// math is indexed by its alttext
+		doc.Find(".epub-math-fallback").Remove()
+		doc.Find("math").Each(func(i int, m *goquery.Selection) {
+			m.ReplaceWithHtml(" " + html.EscapeString(mathText(m)) + " ")
+		})
 		url := navPoint.UpdateExt(navPoint.Src)
+		body, pageOffsets := indexPages(doc.Selection)
 		indexs[url] = &DocIndex{
 			Url:      url,
 			Title:    navPoint.Title,
 			Keywords: "",
-			Body:     doc.Text(),
+			Body:     body,
+			Pages:    pageOffsets,
 		}
 	}
 	data, _ := json.Marshal(indexs)
@@ -501,6 +631,17 @@ func (ncx *NCX) RenderNavigation(np *NavPoint) (string, error) {
 			"rel":  np.RelativePath,
 			"ext":  np.UpdateExt,
 			"base": np.BasePath,
+			"href": np.Href,
+			"landmarks": func() []*NavPoint {
+				return ncx.Landmarks
+			},
+			"numbering": func() bool {
+				return ncx.tocNumbering
+			},
+			// sub entries deeper than the depth of TOC override are not shown
+			"expand": func(nav *NavPoint) bool {
+				return ncx.tocDepth <= 0 || nav.Depth < ncx.tocDepth
+			},
 		},
 	).Parse(string(navi))
 	if err != nil {
@@ -519,22 +660,47 @@ func (ncx *NCX) UpdateNavMap() {
 	for i, v := range ncx.NavMap {
 		prev = ncx.updateNavPoint(prev, v, 0, i, "")
 	}
+	for _, v := range ncx.Hidden {
+		ncx.initNavPoint(v)
+	}
 }
 
-func (ncx *NCX) updateNavPoint(prev *NavPoint, nav *NavPoint, depth int, index int, level string) (last *NavPoint) {
-	nav.Prev = prev
-	nav.Depth = depth + 1
+// initNavPoint sets up the paths of nav
+func (ncx *NCX) initNavPoint(nav *NavPoint) {
 	sharpIdx := strings.Index(nav.Content.Src, "#")
 	if sharpIdx == -1 {
 		nav.HtmlPath = nav.Content.Src
 	} else {
 		nav.HtmlPath = nav.Content.Src[0:sharpIdx]
 	}
-	nav.SrcRaw = path.Base(nav.Content.Src)
-	nav.Src = path.Base(nav.HtmlPath)
+	// foreign documents are replaced by their fallbacks
+	if mf, ok := ncx.manifestItems[cleanHref(nav.HtmlPath)]; ok {
+		if rendered := ncx.OPF.findRenderable(mf); rendered != nil && rendered != mf {
+			nav.HtmlPath = rendered.Href
+		}
+	}
+	if fragment(nav.Content.Src) != "" {
+		nav.Part = ncx.partOf(nav.HtmlPath, nav.Content.Src)
+	}
+	nav.Src = ncx.partPath(nav.HtmlPath, nav.Part)
+	nav.SrcRaw = nav.Src + ncx.mergedSuffix(nav.HtmlPath, fragment(nav.Content.Src))
 	nav.Dir = path.Dir(nav.Content.Src)
+	nav.ItemRef = ncx.itemRefs[cleanHref(nav.HtmlPath)]
+	nav.NonLinear = nav.ItemRef != nil && !nav.ItemRef.isLinear()
+	nav.Fixed = ncx.isFixed(nav.ItemRef)
+	if !nav.Group {
+		nav.Media = ncx.pageMedia(cleanHref(nav.HtmlPath))
+	}
+	// merged documents are rendered into the page of the first one
+	nav.HtmlPath = ncx.mergedHead(nav.HtmlPath)
 
 	nav.NCX = ncx
+}
+
+func (ncx *NCX) updateNavPoint(prev *NavPoint, nav *NavPoint, depth int, index int, level string) (last *NavPoint) {
+	nav.Prev = prev
+	nav.Depth = depth + 1
+	ncx.initNavPoint(nav)
 	/*
 		nav.WorkDir = ncx.WorkDir
 		nav.GitbookUrl = ncx.GitbookUrl
@@ -581,6 +747,9 @@ func (np *NavPoint) RenderPage(navi string) ([]byte, error) {
 			"base": np.BasePath,
 			"ext":  np.UpdateExt,
 			"trim": np.TrimHash,
+			"href": np.Href,
+			"root": np.RootPath,
+			"rtl":  np.IsRTL,
 			"now":  now,
 		},
 	).Parse(string(page))
@@ -592,10 +761,18 @@ func (np *NavPoint) RenderPage(navi string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	np.Overlay, err = np.loadOverlay()
+	if err != nil {
+		return nil, err
+	}
 	// TODO just workaround for load all styles
 	// should load styles from new page
 	for _, style := range np.NCX.Styles {
-		np.HeadLinks = fmt.Sprintf(`%s<link href="%s" rel="stylesheet" type="text/css">`, np.HeadLinks, style.Href)
+		href, ok := np.NCX.ResolveAsset(".", np.Src, style.Href)
+		if !ok {
+			continue
+		}
+		np.HeadLinks = fmt.Sprintf(`%s<link href="%s" rel="stylesheet" type="text/css">`, np.HeadLinks, href)
 	}
 	err = tmpl.Execute(&buf, np)
 	if err != nil {
@@ -616,10 +793,14 @@ func (np *NavPoint) save(data []byte) error {
 	if _, err := os.Stat(outDir); os.IsNotExist(err) {
 		os.MkdirAll(outDir, os.ModePerm)
 	}
-	if path.Ext(outPath) == ".xhtml" {
-		idx := strings.LastIndex(outPath, ".")
+	if path.Ext(np.HtmlPath) == ".xhtml" && !np.Fixed {
 		os.Remove(path.Join(np.NCX.OutDir, np.HtmlPath))
-		outPath = fmt.Sprintf("%s.html", outPath[:idx])
+	}
+	// the documents merged into this page are not pages any more
+	for _, doc := range np.NCX.pageDocs(np.HtmlPath)[1:] {
+		if !np.NCX.pageNames[doc] {
+			os.Remove(path.Join(np.NCX.OutDir, doc))
+		}
 	}
 	return ioutil.WriteFile(outPath, data, 0644)
 }
@@ -632,109 +813,66 @@ func (np *NavPoint) loadHtml() error {
 	htmlPath := path.Join(np.NCX.WorkDir, np.HtmlPath)
 	//fmt.Println(htmlPath)
 	_, err := os.Stat(htmlPath)
-	// url escape
-	if os.IsNotExist(err) {
-		htmlPath, err = url.QueryUnescape(htmlPath)
-		if err != nil {
-			return err
-		}
+	// url escape, generated pages are not in the work directory
+	if _, generated := np.NCX.generatedLists[cleanHref(np.HtmlPath)]; os.IsNotExist(err) && !generated {
 		np.HtmlPath, err = url.QueryUnescape(np.HtmlPath)
 		if err != nil {
 			return err
 		}
-		np.Src, err = url.QueryUnescape(np.Src)
-		if err != nil {
-			return err
-		}
 	}
-	htmlFile, err := os.OpenFile(htmlPath, os.O_RDONLY, 0644)
+	htmlFile, err := np.NCX.openDocument(np.HtmlPath)
 	if err != nil {
 		return err
 	}
 	defer htmlFile.Close()
-	ext := path.Ext(htmlPath)
-	switch ext {
-	case ".xhtml":
-		data, err := ioutil.ReadAll(htmlFile)
-		if err != nil {
-			panic(err)
-		}
-		x := xhtml{}
-		d := xml.NewDecoder(bytes.NewReader([]byte(data)))
-		d.Strict = false
-		err = d.Decode(&x)
-		if err != nil {
-			panic(err)
-		}
-		np.Body = x.Body.Inner
-	case ".html":
-		doc, err := goquery.NewDocumentFromReader(htmlFile)
+	var doc *goquery.Document
+	mediaType := np.NCX.mediaType(np.HtmlPath)
+	switch {
+	case mediaType == MediaTypeImageSVG:
+		doc, err = np.loadSvg(htmlFile)
+	case isImage(mediaType):
+		// wrap the image with a page, the src is relative to the image itself and rewritten as other images
+		src := (&url.URL{Path: path.Base(cleanHref(np.HtmlPath))}).EscapedPath()
+		body := fmt.Sprintf(`<div class="epub-image-page"><img src="%s" alt="%s"/></div>`, src, html.EscapeString(np.Title))
+		doc, err = goquery.NewDocumentFromReader(strings.NewReader(body))
+	case mediaType == MediaTypeHTML || mediaType == MediaTypeTextHTML:
+		doc, err = parseContent(htmlFile, mediaType == MediaTypeHTML, np.HtmlPath)
 		if err != nil {
 			return err
 		}
-		np.Body, err = doc.Find("body").First().Html()
-		if err != nil {
-			return err
-		}
-	case ".jpg":
-		rel, _ := filepath.Rel(np.Dir, np.Content.Src)
-		np.Body = fmt.Sprintf(`<img src="%s"/>`, rel)
-		np.Src = strings.Replace(np.Src, ".jpg", ".html", strings.Index(np.Src, ".jpg"))
+		root, body := doc.Find("html").First(), doc.Find("body").First()
+		np.Lang = firstNonEmpty(body.AttrOr("lang", ""), root.AttrOr("lang", ""))
+		np.Direction = firstNonEmpty(body.AttrOr("dir", ""), root.AttrOr("dir", ""))
 	default:
-		panic(fmt.Sprintf("unsupported file type: %s", htmlPath))
-	}
-	buf := bytes.NewBufferString(np.Body)
-	doc, err := goquery.NewDocumentFromReader(buf)
-	// TODO update image src
-	doc.Find("img").Each(func(i int, s *goquery.Selection) {
-		src, exist := s.Attr("src")
-		if !exist {
-			return
-		}
-		newSrc := path.Join(np.Dir, path.Join(src))
-		s.SetAttr("src", newSrc)
-	})
-	doc.Find("image").Each(func(i int, s *goquery.Selection) {
-		src, exist := s.Attr("href")
-		if !exist {
-			return
-		}
-		newSrc := path.Join(np.Dir, path.Join(src))
-		s.SetAttr("href", newSrc)
-	})
-	// update link href
-	// 1. path
-	// 2. ext
-	doc.Find("a").Each(func(i int, s *goquery.Selection) {
-		href, exist := s.Attr("href")
-		if !exist {
-			return
-		}
-		if path.IsAbs(href) ||
-			strings.HasPrefix(href, "http://") ||
-			strings.HasPrefix(href, "https://") ||
-			strings.HasPrefix(href, "//") ||
-			strings.HasPrefix(href, "#") {
-			return
-		}
-		s.SetAttr("href", np.UpdateExt(path.Base(href)))
-	})
-	// TODO rename duplication of name css style
-
-	np.Body, err = doc.Selection.Html()
+		fmt.Fprintf(os.Stderr, "warnning: unsupported file type %s (%s) without renderable fallback, title: %s\n", np.HtmlPath, mediaType, np.Title)
+		src := (&url.URL{Path: path.Base(cleanHref(np.HtmlPath))}).EscapedPath()
+		body := fmt.Sprintf(`<p><a href="%s">%s</a></p>`, src, html.EscapeString(np.Title))
+		doc, err = goquery.NewDocumentFromReader(strings.NewReader(body))
+	}
 	if err != nil {
-		panic(err)
+		return err
 	}
+	np.Lang = firstNonEmpty(np.Lang, np.NCX.Language)
+	// the text direction is not the page progression direction of the book
+	if np.Direction != "rtl" && np.Direction != "ltr" {
+		np.Direction = textDirection(np.Lang)
+	}
+	np.NCX.markIds(doc)
+	np.mergeDocs(doc)
+	np.selectPart(doc)
+	prepareMath(doc)
+	prepareSvg(doc)
+	np.prepareMedia(doc)
+	np.markPageBreaks(doc)
+	notes := np.findNotes(doc)
+	np.rewriteLinks(doc)
+	np.appendNotes(doc, notes)
+	// TODO rename duplication of name css style
 
-	// TODO remove outer html tag
-	x := xhtml{}
-	d := xml.NewDecoder(bytes.NewReader([]byte(np.Body)))
-	d.Strict = false
-	err = d.Decode(&x)
+	np.Body, err = doc.Find("body").First().Html()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	np.Body = x.Body.Inner
 	/*
 		np.HeadLinks, err = doc.Find("head").First().Html()
 		if err != nil {
@@ -752,24 +890,24 @@ func (np *NavPoint) loadHtml() error {
 	return nil
 }
 
+// FindNextHtml returns the next page in reading order, non-linear pages have no next page
 func (np *NavPoint) FindNextHtml() *NavPoint {
-	p := np.Next
-	for p != nil {
-		if p.Src != np.Src {
-			return p
-		}
-		p = p.Next
+	if np.NonLinear {
+		return nil
+	}
+	if i, ok := np.NCX.readingIndex[np.Src]; ok && i+1 < len(np.NCX.readingOrder) {
+		return np.NCX.readingOrder[i+1]
 	}
 	return nil
 }
 
+// FindPrevHtml returns the previous page in reading order, non-linear pages have no previous page
 func (np *NavPoint) FindPrevHtml() *NavPoint {
-	p := np.Prev
-	for p != nil {
-		if p.Src != np.Src {
-			return p
-		}
-		p = p.Prev
+	if np.NonLinear {
+		return nil
+	}
+	if i, ok := np.NCX.readingIndex[np.Src]; ok && i > 0 {
+		return np.NCX.readingOrder[i-1]
 	}
 	return nil
 }
@@ -795,15 +933,33 @@ func (np *NavPoint) BasePath(npx *NavPoint) string {
 	return path.Base(npx.Content.Src)
 }
 
+// IsRTL reports whether the pages progress from right to left, the left arrow goes to the next page
+func (np *NavPoint) IsRTL() bool {
+	return np.NCX.PageProgression == "rtl"
+}
+
+// Href returns the url of npx relative to the page of np
+func (np *NavPoint) Href(npx *NavPoint) string {
+	return relativeUrl(path.Dir(np.Src), npx.Src) + fragment(npx.SrcRaw)
+}
+
+// RootPath returns the url of output directory relative to the page of np
+func (np *NavPoint) RootPath() string {
+	if root := relativeUrl(path.Dir(np.Src), "."); root != "" {
+		return root
+	}
+	return "."
+}
+
 func (np *NavPoint) UpdateExt(orig string) string {
+	return updateExt(orig)
+}
+
+func updateExt(orig string) string {
 	if strings.HasPrefix(path.Ext(orig), ".xhtml") {
 		idx := strings.LastIndex(orig, ".")
 		orig = strings.Replace(orig, ".xhtml", ".html", idx)
 	}
-	if strings.HasPrefix(path.Ext(orig), ".jpg") {
-		idx := strings.LastIndex(orig, ".")
-		orig = strings.Replace(orig, ".jpg", ".html", idx)
-	}
 	return orig
 }
 
@@ -13,14 +13,13 @@ type NavDoc struct {
 
 type Body struct {
 	XMLName xml.Name `xml:"body"`
-	Nav     []*Nav   `xml:"nav"`
-	// some epub has an extra "section"
-	Section Section  `xml:"section"`
+	navContainer
 }
 
-type Section struct {
-	XMLName xml.Name `xml:"section"`
-	Nav     []*Nav   `xml:"nav"`
+// navContainer is an element of nav document, navs may be nested in sections, divs and others at any depth
+type navContainer struct {
+	Nav      []*Nav          `xml:"nav"`
+	Children []*navContainer `xml:",any"`
 }
 
 type Nav struct {
@@ -31,31 +30,59 @@ type Nav struct {
 
 type Item struct {
 	ItemInner []*ItemInner `xml:"li"`
+	// Hidden is not nil when the list is hidden, like the deep levels of TOC
+	Hidden *string `xml:"hidden,attr"`
 }
 
 type ItemInner struct {
 	SubItem *Item  `xml:"ol"`
 	Anchor  anchor `xml:"a"`
+	// Span is the label of a heading without link
+	Span   anchor  `xml:"span"`
+	Hidden *string `xml:"hidden,attr"`
 }
 
 type anchor struct {
 	Title string `xml:",innerxml"`
 	Href  string `xml:"href,attr"`
+	// Type is epub:type of landmarks
+	Type string `xml:"type,attr"`
 }
 
-func LoadNavDoc(navPath string) *NavDoc {
+// LoadNavDoc reads the EPUB 3 nav document
+func LoadNavDoc(navPath string) (*NavDoc, error) {
 	f, err := os.Open(navPath)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer f.Close()
 	data, err := ioutil.ReadAll(f)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	doc := &NavDoc{}
 	err = xml.Unmarshal(data, &doc)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return doc
+	return doc, nil
+}
+
+// findNav returns the nav of epub:type, like "toc" or "page-list"
+func (doc *NavDoc) findNav(navType string) *Nav {
+	return doc.Body.findNav(navType)
+}
+
+func (c *navContainer) findNav(navType string) *Nav {
+	for _, v := range c.Nav {
+		if v.Type == navType {
+			return v
+		}
+	}
+	for _, child := range c.Children {
+		if v := child.findNav(navType); v != nil {
+			return v
+		}
+	}
+	return nil
 }
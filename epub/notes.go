@@ -0,0 +1,245 @@
+package epub
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// epub:type and ARIA role values of notes, epub:type is kept as data-epub-type by parseContent
+var (
+	noteTypes          = []string{"footnote", "endnote", "rearnote", "note"}
+	noteRoles          = []string{"doc-footnote", "doc-endnote"}
+	noteContainerTypes = []string{"footnotes", "endnotes", "rearnotes"}
+	noteContainerRoles = []string{"doc-endnotes"}
+	// classes of note references without semantics
+	noteRefClasses = []string{"footnote", "noteref", "fn"}
+)
+
+// note blocks of books converted by Calibre and others, which link back to the reference without semantics
+const noteBlockSelector = "p, li, dd, div, aside"
+
+// hasToken reports whether the space separated attr of s contains one of tokens
+func hasToken(s *goquery.Selection, attr string, tokens ...string) bool {
+	for _, v := range strings.Fields(s.AttrOr(attr, "")) {
+		for _, t := range tokens {
+			if v == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isNoteRef(a *goquery.Selection) bool {
+	return hasToken(a, "data-epub-type", "noteref") || hasToken(a, "role", "doc-noteref")
+}
+
+func isNote(s *goquery.Selection) bool {
+	return hasToken(s, "data-epub-type", noteTypes...) || hasToken(s, "role", noteRoles...)
+}
+
+// linksBack reports whether s, found in content document target, links to note reference a of content document docHref.
+// Asides without semantics are notes only when they link back, others are sidebars.
+func linksBack(s *goquery.Selection, target string, a *goquery.Selection, docHref string) bool {
+	ids := make(map[string]bool)
+	a.AddSelection(a.Find("[id]")).AddSelection(a.ParentsUntil("body").Filter("sup, span")).Each(func(i int, r *goquery.Selection) {
+		if id := r.AttrOr("id", ""); id != "" {
+			ids[id] = true
+		}
+	})
+	if len(ids) == 0 {
+		return false
+	}
+	back := false
+	s.Find("a[href]").EachWithBreak(func(i int, l *goquery.Selection) bool {
+		doc, suffix := resolveRef(target, strings.TrimSpace(l.AttrOr("href", "")))
+		if doc == "" {
+			doc = target
+		}
+		id, err := url.PathUnescape(strings.TrimPrefix(fragment(suffix), "#"))
+		back = doc == docHref && err == nil && ids[id]
+		return !back
+	})
+	return back
+}
+
+// looksLikeNoteRef reports whether a link without semantics is styled like a note reference, like <a><sup>1</sup></a>
+func looksLikeNoteRef(a *goquery.Selection) bool {
+	if len([]rune(strings.TrimSpace(a.Text()))) > 6 {
+		return false
+	}
+	if a.Find("sup").Length() > 0 || a.Closest("sup").Length() > 0 {
+		return true
+	}
+	return hasToken(a, "class", noteRefClasses...)
+}
+
+// findNote returns the note referenced by link a found in content document docHref
+func (ncx *NCX) findNote(a *goquery.Selection, docHref string) (note *goquery.Selection, noteHref string) {
+	semantic := isNoteRef(a)
+	if !semantic && !looksLikeNoteRef(a) {
+		return nil, ""
+	}
+	ref := strings.TrimSpace(a.AttrOr("href", ""))
+	target, suffix := docHref, ref
+	if !strings.HasPrefix(ref, "#") {
+		if isExternalRef(ref) {
+			return nil, ""
+		}
+		target, suffix = resolveRef(docHref, ref)
+	}
+	id, err := url.PathUnescape(strings.TrimPrefix(fragment(suffix), "#"))
+	if err != nil || id == "" {
+		return nil, ""
+	}
+	doc := ncx.contentDocument(target)
+	if doc == nil {
+		return nil, ""
+	}
+	el := doc.Find("[id]").FilterFunction(func(i int, s *goquery.Selection) bool {
+		return s.AttrOr("id", "") == id
+	}).First()
+	if el.Length() == 0 {
+		return nil, ""
+	}
+	for s := el; s.Length() > 0 && goquery.NodeName(s) != "body"; s = s.Parent() {
+		if isNote(s) || (goquery.NodeName(s) == "aside" && linksBack(s, target, a, docHref)) {
+			return s, target
+		}
+	}
+	if !semantic {
+		// the note without semantics must link back to the reference
+		backlink := el.Filter("a[href]").AddSelection(el.Find("a[href]")).First()
+		if back, _ := resolveRef(target, trimSharp(backlink.AttrOr("href", ""))); back != docHref {
+			return nil, ""
+		}
+	}
+	if block := el.Closest(noteBlockSelector); block.Length() > 0 {
+		return block, target
+	}
+	return el, target
+}
+
+// findNotes marks the note references of np, the notes are returned in the order of marks
+func (np *NavPoint) findNotes(doc *goquery.Document) []string {
+	var notes []string
+	docHref := cleanHref(np.HtmlPath)
+	doc.Find("a[href]").Each(func(i int, a *goquery.Selection) {
+		note, noteHref := np.NCX.findNote(a, docHref)
+		if note == nil {
+			return
+		}
+		inner, err := note.Html()
+		if err != nil {
+			return
+		}
+		content, err := goquery.NewDocumentFromReader(strings.NewReader(inner))
+		if err != nil {
+			return
+		}
+		np.NCX.rewriteRefs(content.Selection, noteHref, np.Src)
+		// the note may be on this page too
+		content.Find("[id]").RemoveAttr("id")
+		inner, err = content.Find("body").Html()
+		if err != nil {
+			return
+		}
+		a.SetAttr("data-epub-note", fmt.Sprintf("epub-note-%d", len(notes)+1))
+		notes = append(notes, inner)
+	})
+	return notes
+}
+
+// appendNotes appends popovers of notes to the body, links to notes are rewritten already
+func (np *NavPoint) appendNotes(doc *goquery.Document, notes []string) {
+	if len(notes) == 0 {
+		return
+	}
+	var buf strings.Builder
+	buf.WriteString(`<div class="epub-note-popovers">`)
+	doc.Find("a[data-epub-note]").Each(func(i int, a *goquery.Selection) {
+		if i >= len(notes) {
+			return
+		}
+		id := a.AttrOr("data-epub-note", "")
+		a.SetAttr("aria-haspopup", "true")
+		a.SetAttr("aria-expanded", "false")
+		a.SetAttr("aria-controls", id)
+		fmt.Fprintf(&buf, `<aside id="%s" class="epub-note-popover" role="doc-footnote" tabindex="-1" hidden="hidden">`, id)
+		fmt.Fprintf(&buf, `<div class="epub-note-content">%s</div>`, notes[i])
+		fmt.Fprintf(&buf, `<a class="epub-note-link" href="%s">Go to note</a></aside>`, a.AttrOr("href", ""))
+	})
+	buf.WriteString(`</div>`)
+	doc.Find("body").AppendHtml(buf.String())
+}
+
+// isNotesDocument reports whether the content document href contains nothing but notes and headings
+func (ncx *NCX) isNotesDocument(href string) bool {
+	doc := ncx.contentDocument(href)
+	if doc == nil {
+		return false
+	}
+	body := doc.Find("body").First().Clone()
+	notes := body.Find("*").FilterFunction(func(i int, s *goquery.Selection) bool {
+		return isNote(s) || hasToken(s, "data-epub-type", noteContainerTypes...) || hasToken(s, "role", noteContainerRoles...)
+	})
+	if notes.Length() == 0 && !hasToken(body, "data-epub-type", noteContainerTypes...) {
+		return false
+	}
+	notes.Remove()
+	body.Find("h1, h2, h3, h4, h5, h6, header").Remove()
+	return strings.TrimSpace(body.Text()) == ""
+}
+
+// hideNotesPages keeps the standalone notes pages out of the TOC
+func (ncx *NCX) hideNotesPages() {
+	kept := false
+	for _, nav := range ncx.NavMap {
+		kept = kept || nav.Group || !ncx.isNotesDocument(cleanHref(trimSharp(nav.Content.Src)))
+	}
+	if !kept {
+		fmt.Fprintf(os.Stderr, "warnning: the book contains notes only, notes pages are kept in TOC\n")
+		return
+	}
+	hidden := make(map[string]bool)
+	for _, nav := range ncx.Hidden {
+		hidden[cleanHref(trimSharp(nav.Content.Src))] = true
+	}
+	ncx.NavMap = ncx.hideNotes(ncx.NavMap, hidden)
+}
+
+// hideNotes moves nav points of notes documents out of navs, their pages are still rendered
+func (ncx *NCX) hideNotes(navs []*NavPoint, hidden map[string]bool) []*NavPoint {
+	var kept []*NavPoint
+	for _, nav := range navs {
+		nav.SubNavPoints = ncx.hideNotes(nav.SubNavPoints, hidden)
+		if nav.Group {
+			if len(nav.SubNavPoints) > 0 {
+				nav.Content.Src = nav.SubNavPoints[0].Content.Src
+				kept = append(kept, nav)
+			}
+			continue
+		}
+		doc := cleanHref(trimSharp(nav.Content.Src))
+		if !ncx.isNotesDocument(doc) {
+			kept = append(kept, nav)
+			continue
+		}
+		// entries of other documents take the place of the notes
+		for _, sub := range nav.SubNavPoints {
+			if cleanHref(trimSharp(sub.Content.Src)) != doc {
+				kept = append(kept, sub)
+			}
+		}
+		nav.SubNavPoints = nil
+		if !hidden[doc] {
+			hidden[doc] = true
+			ncx.Hidden = append(ncx.Hidden, nav)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,171 @@
+package epub
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// the class applied to the playing fragment when the book does not declare media:active-class
+const defaultActiveClass = "-epub-media-overlay-active"
+
+// OverlayClip is an audio clip synchronized with a text fragment of a page
+type OverlayClip struct {
+	// Id of the element in the page, empty for the whole page
+	Id string `json:"id"`
+	// Audio is the url of the audio relative to the page
+	Audio string  `json:"audio"`
+	Begin float64 `json:"begin"`
+	// End is negative when the clip plays to the end of the audio
+	End float64 `json:"end"`
+}
+
+type smil struct {
+	Body smilNode `xml:"body"`
+}
+
+// smilNode is a seq or par, children keep the document order
+type smilNode struct {
+	XMLName  xml.Name
+	Text     *smilText  `xml:"text"`
+	Audio    *smilAudio `xml:"audio"`
+	Children []smilNode `xml:",any"`
+}
+
+type smilText struct {
+	Src string `xml:"src,attr"`
+}
+
+type smilAudio struct {
+	Src       string `xml:"src,attr"`
+	ClipBegin string `xml:"clipBegin,attr"`
+	ClipEnd   string `xml:"clipEnd,attr"`
+}
+
+type overlayClip struct {
+	smilHref string
+	id       string
+	audio    *smilAudio
+}
+
+// loadOverlays parses the SMIL media overlays referenced by manifest items,
+// clips are collected by the content documents they synchronize
+func (ncx *NCX) loadOverlays(opf *OPF) {
+	ncx.ActiveClass = firstNonEmpty(opf.findMeta("media:active-class"), defaultActiveClass)
+	ncx.overlays = make(map[string][]*overlayClip)
+	loaded := make(map[string]bool)
+	for _, m := range opf.Manifests {
+		if m.MediaOverlay == "" {
+			continue
+		}
+		mo := opf.findManifestItem(m.MediaOverlay)
+		if mo == nil {
+			fmt.Fprintf(os.Stderr, "warnning: media overlay %s of %s not found in manifest\n", m.MediaOverlay, m.Href)
+			continue
+		}
+		smilHref := cleanHref(mo.Href)
+		if loaded[smilHref] {
+			continue
+		}
+		loaded[smilHref] = true
+		if err := ncx.loadOverlay(smilHref); err != nil {
+			fmt.Fprintf(os.Stderr, "warnning: media overlay %s is ignored: %s\n", smilHref, err)
+		}
+	}
+}
+
+func (ncx *NCX) loadOverlay(smilHref string) error {
+	f, err := os.Open(path.Join(ncx.WorkDir, smilHref))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var s smil
+	if err = xml.NewDecoder(f).Decode(&s); err != nil {
+		return err
+	}
+	ncx.collectClips(smilHref, s.Body)
+	return nil
+}
+
+func (ncx *NCX) collectClips(smilHref string, node smilNode) {
+	if node.XMLName.Local == "par" && node.Text != nil && node.Audio != nil {
+		doc, suffix := resolveRef(smilHref, node.Text.Src)
+		ncx.overlays[doc] = append(ncx.overlays[doc], &overlayClip{
+			smilHref: smilHref,
+			id:       strings.TrimPrefix(suffix, "#"),
+			audio:    node.Audio,
+		})
+	}
+	for _, child := range node.Children {
+		ncx.collectClips(smilHref, child)
+	}
+}
+
+// loadOverlay returns the clips of np as json, or an empty string when the page has no media overlay
+func (np *NavPoint) loadOverlay() (string, error) {
+	var clips []*OverlayClip
+	for _, docHref := range np.NCX.pageDocs(np.HtmlPath) {
+		for _, c := range np.NCX.overlays[docHref] {
+			// parts of a split document play the clips of their own fragments
+			if np.NCX.partOf(docHref, "#"+c.id) != np.Part {
+				continue
+			}
+			audio, ok := np.NCX.ResolveAsset(c.smilHref, np.Src, c.audio.Src)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "warnning: audio %s of media overlay %s not found\n", c.audio.Src, c.smilHref)
+				continue
+			}
+			clip := &OverlayClip{Id: np.NCX.mergedTarget(docHref, c.id), Audio: audio, End: -1}
+			if c.audio.ClipBegin != "" {
+				clip.Begin = parseClock(c.audio.ClipBegin)
+			}
+			if c.audio.ClipEnd != "" {
+				clip.End = parseClock(c.audio.ClipEnd)
+			}
+			clips = append(clips, clip)
+		}
+	}
+	if len(clips) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(clips)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// parseClock parses SMIL clock values into seconds, like "0:01:02.5", "01:02.5", "62.5s", "500ms", "1.5min" and "1h"
+func parseClock(value string) float64 {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "npt=")
+	if strings.Contains(value, ":") {
+		var seconds float64
+		for _, part := range strings.Split(value, ":") {
+			v, _ := strconv.ParseFloat(part, 64)
+			seconds = seconds*60 + v
+		}
+		return seconds
+	}
+	units := []struct {
+		suffix string
+		scale  float64
+	}{
+		{"ms", 0.001},
+		{"min", 60},
+		{"h", 3600},
+		{"s", 1},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(value, u.suffix) {
+			v, _ := strconv.ParseFloat(strings.TrimSuffix(value, u.suffix), 64)
+			return v * u.scale
+		}
+	}
+	v, _ := strconv.ParseFloat(value, 64)
+	return v
+}
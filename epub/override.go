@@ -0,0 +1,301 @@
+package epub
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TocOverride is the YAML file of Options.TocOverride, it describes TOC with the entries of the book.
+// Entries of the book missing in the file are dropped, MergeSpine adds their spine items back by reading order.
+type TocOverride struct {
+	// Depth caps the levels shown in navigation, 0 shows all of them
+	Depth int `yaml:"depth"`
+	// Numbering shows level numbers like "1.2.3" before titles
+	Numbering bool        `yaml:"numbering"`
+	Toc       []*TocEntry `yaml:"toc"`
+}
+
+// TocEntry is an entry of TocOverride. It takes the entries of the book with Href, relative to the directory of OPF,
+// or with the titles matching Match, or both. An entry matching nothing with Href is added to TOC,
+// an entry without Href and Match groups its children.
+type TocEntry struct {
+	// Title renames the entries, it is required by groups
+	Title string `yaml:"title,omitempty"`
+	Href  string `yaml:"href,omitempty"`
+	// Match is a regular expression of titles
+	Match string `yaml:"match,omitempty"`
+	// Hide keeps the entries out of TOC, they are still rendered
+	Hide bool `yaml:"hide,omitempty"`
+	// Children replace the sub entries, the sub entries of the book are kept when Children is missing
+	Children []*TocEntry `yaml:"children,omitempty"`
+
+	match *regexp.Regexp
+}
+
+// LoadTocOverride reads the TOC override file
+func LoadTocOverride(file string) (*TocOverride, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	o := &TocOverride{}
+	if err = yaml.UnmarshalStrict(data, o); err != nil {
+		return nil, fmt.Errorf("TOC override %s: %s", file, err)
+	}
+	if err = compileEntries(o.Toc); err != nil {
+		return nil, fmt.Errorf("TOC override %s: %s", file, err)
+	}
+	return o, nil
+}
+
+func compileEntries(entries []*TocEntry) error {
+	for _, e := range entries {
+		if e.Match != "" {
+			re, err := regexp.Compile(e.Match)
+			if err != nil {
+				return err
+			}
+			e.match = re
+		}
+		if e.Href == "" && e.Match == "" && e.Title == "" {
+			return fmt.Errorf("an entry without href and match must have a title")
+		}
+		if err := compileEntries(e.Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tocHref returns src with unescaped document, entries of the override are compared by it
+func tocHref(src string) string {
+	return cacheKey(src) + fragment(src)
+}
+
+// applyTocOverride rebuilds TOC by o, it must be called before MergeSpine.
+// The spine items missing in TOC are taken too, with the titles given by MergeSpine,
+// so the entries printed by inspect work in the override.
+func (ncx *NCX) applyTocOverride(opf *OPF, o *TocOverride) {
+	ncx.tocDepth, ncx.tocNumbering = o.Depth, o.Numbering
+	flat := flattenNavs(ncx.NavMap, nil)
+	candidates := append(append([]flatNav{}, flat...), ncx.spineNavs(opf, flat)...)
+	// the entries of the book taken by the entries of override, an entry of the book is taken once
+	taken := make(map[*TocEntry][]*NavPoint)
+	claimed := make(map[*NavPoint]bool)
+	var claim func(entries []*TocEntry)
+	claim = func(entries []*TocEntry) {
+		for _, e := range entries {
+			for _, f := range candidates {
+				nav := f.nav
+				if claimed[nav] || (e.Href == "" && e.match == nil) {
+					continue
+				}
+				if e.Href != "" && (nav.Group || tocHref(nav.Content.Src) != tocHref(e.Href)) {
+					continue
+				}
+				if e.match != nil && !e.match.MatchString(nav.Title) {
+					continue
+				}
+				claimed[nav] = true
+				taken[e] = append(taken[e], nav)
+			}
+			claim(e.Children)
+		}
+	}
+	claim(o.Toc)
+
+	var hidden []*NavPoint
+	var build func(entries []*TocEntry) []*NavPoint
+	build = func(entries []*TocEntry) []*NavPoint {
+		var navs []*NavPoint
+		for _, e := range entries {
+			if e.Hide {
+				if len(taken[e]) == 0 {
+					if e.Href != "" {
+						// a page of the book neither in TOC nor in spine
+						if nav := ncx.overrideNav(opf, e); nav != nil {
+							hidden = append(hidden, nav)
+						}
+					} else {
+						fmt.Fprintf(os.Stderr, "warnning: TOC override entry %q matches nothing, skipped\n", e.Match)
+					}
+				}
+				for _, nav := range taken[e] {
+					for _, f := range flattenNavs([]*NavPoint{nav}, nil) {
+						if !f.nav.Group && (f.nav == nav || !claimed[f.nav]) {
+							hidden = append(hidden, f.nav)
+						}
+					}
+				}
+				continue
+			}
+			if len(taken[e]) > 0 {
+				for _, nav := range taken[e] {
+					if e.Title != "" {
+						nav.Title = e.Title
+					}
+					if e.Children != nil {
+						nav.SubNavPoints = build(e.Children)
+					} else {
+						nav.SubNavPoints = unclaimed(nav.SubNavPoints, claimed)
+					}
+				}
+				navs = append(navs, taken[e]...)
+				continue
+			}
+			switch {
+			case e.Href != "":
+				if nav := ncx.overrideNav(opf, e); nav != nil {
+					nav.SubNavPoints = build(e.Children)
+					navs = append(navs, nav)
+				}
+			case e.match != nil:
+				fmt.Fprintf(os.Stderr, "warnning: TOC override entry %q matches nothing, skipped\n", e.Match)
+			default:
+				subs := build(e.Children)
+				if len(subs) == 0 {
+					fmt.Fprintf(os.Stderr, "warnning: TOC override group %s is empty, skipped\n", e.Title)
+					continue
+				}
+				navs = append(navs, &NavPoint{
+					Title: e.Title,
+					Content: content{
+						Src: subs[0].Content.Src,
+					},
+					SubNavPoints: subs,
+					Group:        true,
+				})
+			}
+		}
+		return navs
+	}
+	ncx.NavMap = build(o.Toc)
+
+	dropped := 0
+	kept := make(map[*NavPoint]bool)
+	for _, f := range flattenNavs(ncx.NavMap, nil) {
+		kept[f.nav] = true
+	}
+	for _, nav := range hidden {
+		kept[nav] = true
+	}
+	for _, f := range flat {
+		if !kept[f.nav] && !f.nav.Group {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		fmt.Fprintf(os.Stderr, "warnning: %d TOC entries missing in TOC override are dropped\n", dropped)
+	}
+	known := make(map[string]bool)
+	for _, nav := range ncx.Hidden {
+		known[cacheKey(nav.Content.Src)] = true
+	}
+	for _, nav := range hidden {
+		nav.SubNavPoints = nil
+		if !known[cacheKey(nav.Content.Src)] {
+			known[cacheKey(nav.Content.Src)] = true
+			ncx.Hidden = append(ncx.Hidden, nav)
+		}
+	}
+}
+
+// spineNavs returns the nav points MergeSpine would add for the spine items missing in TOC
+func (ncx *NCX) spineNavs(opf *OPF, flat []flatNav) []flatNav {
+	known := make(map[string]bool)
+	for _, f := range flat {
+		known[cacheKey(f.nav.Content.Src)] = true
+	}
+	for _, nav := range ncx.Hidden {
+		known[cacheKey(nav.Content.Src)] = true
+	}
+	var navs []flatNav
+	for _, item := range opf.Spine.ItemRefs {
+		mf := opf.findManifestItem(item.Idref)
+		rendered := opf.findRenderable(mf)
+		if rendered == nil || known[cacheKey(rendered.Href)] || known[cacheKey(mf.Href)] {
+			continue
+		}
+		known[cacheKey(rendered.Href)] = true
+		navs = append(navs, flatNav{nav: &NavPoint{
+			Title: ncx.findSpineTitle(rendered, findHTitle),
+			Content: content{
+				Src: rendered.Href,
+			},
+		}})
+	}
+	return navs
+}
+
+// unclaimed returns navs without the ones claimed by the override, which are moved to their entries
+func unclaimed(navs []*NavPoint, claimed map[*NavPoint]bool) []*NavPoint {
+	var kept []*NavPoint
+	for _, nav := range navs {
+		if claimed[nav] {
+			continue
+		}
+		nav.SubNavPoints = unclaimed(nav.SubNavPoints, claimed)
+		kept = append(kept, nav)
+	}
+	return kept
+}
+
+// overrideNav returns the nav point added by e, or nil when e is not a page of the book
+func (ncx *NCX) overrideNav(opf *OPF, e *TocEntry) *NavPoint {
+	mf, ok := ncx.manifestItems[cleanHref(trimSharp(e.Href))]
+	if !ok || opf.findRenderable(mf) == nil {
+		fmt.Fprintf(os.Stderr, "warnning: TOC override entry %s is not a page of the book, skipped\n", e.Href)
+		return nil
+	}
+	title := e.Title
+	if title == "" {
+		rendered := opf.findRenderable(mf)
+		title = ncx.findSpineTitle(rendered, findHTitle)
+	}
+	return &NavPoint{
+		Title: title,
+		Content: content{
+			Src: e.Href,
+		},
+	}
+}
+
+// WriteTocOverride writes TOC in the format of TocOverride, as a starting point of the override file.
+// The pages generated by the converter, like the lists of illustrations, are left out.
+func (ncx *NCX) WriteTocOverride(w io.Writer) error {
+	o := &TocOverride{Depth: ncx.tocDepth, Numbering: ncx.tocNumbering, Toc: ncx.tocEntries(ncx.NavMap)}
+	data, err := yaml.Marshal(o)
+	if err != nil {
+		return err
+	}
+	if ncx.Report != nil && !ncx.Report.Empty() {
+		for _, line := range strings.Split(strings.TrimRight(ncx.Report.String(), "\n"), "\n") {
+			if _, err = fmt.Fprintf(w, "# %s\n", line); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (ncx *NCX) tocEntries(navs []*NavPoint) []*TocEntry {
+	var entries []*TocEntry
+	for _, nav := range navs {
+		if mf, ok := ncx.manifestItems[cacheKey(nav.Content.Src)]; ok && strings.HasPrefix(mf.Id, "epub2website-") && !nav.Group {
+			continue
+		}
+		e := &TocEntry{Title: nav.Title, Children: ncx.tocEntries(nav.SubNavPoints)}
+		if !nav.Group {
+			e.Href = tocHref(nav.Content.Src)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
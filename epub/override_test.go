@@ -0,0 +1,266 @@
+package epub
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+// titles returns navs like tree, with titles instead of documents
+func titles(navs []*NavPoint) string {
+	var parts []string
+	for _, np := range navs {
+		s := np.Title
+		if len(np.SubNavPoints) > 0 {
+			s += "(" + titles(np.SubNavPoints) + ")"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " ")
+}
+
+// loadOverride writes the YAML of TOC override into a file and loads it
+func loadOverride(t *testing.T, data string) (*TocOverride, error) {
+	file := path.Join(t.TempDir(), "toc.yaml")
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadTocOverride(file)
+}
+
+func TestLoadTocOverride(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{
+			name: "entries",
+			data: `
+depth: 2
+numbering: true
+toc:
+- title: Start
+  href: a.xhtml
+  children:
+  - match: ^Sec
+- title: Group
+  children:
+  - href: b.xhtml#x
+    hide: true
+`,
+		},
+		{
+			name:    "unknown field",
+			data:    "toc:\n- title: A\n  herf: a.xhtml\n",
+			wantErr: true,
+		},
+		{
+			name:    "bad regular expression",
+			data:    "toc:\n- match: \"(\"\n",
+			wantErr: true,
+		},
+		{
+			name:    "group without title",
+			data:    "toc:\n- children:\n  - href: a.xhtml\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := loadOverride(t, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadTocOverride() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if o.Depth != 2 || !o.Numbering || len(o.Toc) != 2 {
+				t.Errorf("LoadTocOverride() = %+v", o)
+			}
+			if o.Toc[0].Children[0].match == nil || !o.Toc[0].Children[0].match.MatchString("Section") {
+				t.Errorf("match of %+v is not compiled", o.Toc[0].Children[0])
+			}
+			if !o.Toc[1].Children[0].Hide {
+				t.Errorf("hide of %+v is not read", o.Toc[1].Children[0])
+			}
+		})
+	}
+}
+
+func TestApplyTocOverride(t *testing.T) {
+	// the TOC of book is a(a#1 a#2) c, b and d are missing in TOC
+	spine := []string{"a", "b", "c", "d"}
+	book := func() []*NavPoint {
+		a := nav("a.xhtml", nav("a.xhtml#1"), nav("a.xhtml#2"))
+		a.Title, a.SubNavPoints[0].Title, a.SubNavPoints[1].Title = "A", "Sec 1", "Sec 2"
+		c := nav("c.xhtml")
+		c.Title = "C"
+		return []*NavPoint{a, c}
+	}
+	tests := []struct {
+		name   string
+		data   string
+		want   string
+		hidden string
+	}{
+		{
+			name: "rename and keep sub entries",
+			data: "toc:\n- title: First\n  href: a.xhtml\n- href: c.xhtml\n",
+			want: "First(Sec 1 Sec 2) C",
+		},
+		{
+			name: "move sub entries by match",
+			data: "toc:\n- href: c.xhtml\n  children:\n  - match: ^Sec\n- href: a.xhtml\n",
+			want: "C(Sec 1 Sec 2) A",
+		},
+		{
+			name: "replace sub entries",
+			data: "toc:\n- href: a.xhtml\n  children:\n  - title: Two\n    href: a.xhtml#2\n- href: c.xhtml\n",
+			want: "A(Two) C",
+		},
+		{
+			name: "dropped entries",
+			data: "toc:\n- href: c.xhtml\n",
+			want: "C",
+		},
+		{
+			name:   "hide",
+			data:   "toc:\n- href: a.xhtml\n  hide: true\n- href: c.xhtml\n",
+			want:   "C",
+			hidden: "A",
+		},
+		{
+			name: "group",
+			data: "toc:\n- title: Part\n  children:\n  - href: a.xhtml\n  - href: c.xhtml\n",
+			want: "Part(A(Sec 1 Sec 2) C)",
+		},
+		{
+			name: "spine items missing in TOC",
+			data: "toc:\n- href: a.xhtml\n- href: c.xhtml\n  children:\n  - title: Bee\n    href: b.xhtml\n",
+			want: "A(Sec 1 Sec 2) C(Bee)",
+		},
+		{
+			name: "spine items missing in TOC by match",
+			data: "toc:\n- href: a.xhtml\n- match: ^D heading$\n- href: c.xhtml\n",
+			want: "A(Sec 1 Sec 2) D heading C",
+		},
+		{
+			name:   "hide spine items missing in TOC",
+			data:   "toc:\n- href: a.xhtml\n- href: b.xhtml\n  hide: true\n- match: ^D\n  hide: true\n- href: c.xhtml\n",
+			want:   "A(Sec 1 Sec 2) C",
+			hidden: "B heading D heading",
+		},
+		{
+			name: "entries matching nothing",
+			data: "toc:\n- href: a.xhtml\n- match: ^nothing$\n- match: ^nothing$\n  hide: true\n- href: x.xhtml\n- href: c.xhtml\n",
+			want: "A(Sec 1 Sec 2) C",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := loadOverride(t, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ncx := testBook(t, spine...)
+			ncx.NavMap = book()
+			ncx.applyTocOverride(ncx.OPF, o)
+			if got := titles(ncx.NavMap); got != tt.want {
+				t.Errorf("NavMap = %s, want %s", got, tt.want)
+			}
+			if got := titles(ncx.Hidden); got != tt.hidden {
+				t.Errorf("Hidden = %s, want %s", got, tt.hidden)
+			}
+		})
+	}
+}
+
+func TestTocOverrideOptions(t *testing.T) {
+	o, err := loadOverride(t, "depth: 1\nnumbering: true\ntoc:\n- href: a.xhtml\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ncx := testBook(t, "a")
+	ncx.NavMap = []*NavPoint{nav("a.xhtml", nav("a.xhtml#1"))}
+	ncx.applyTocOverride(ncx.OPF, o)
+	if ncx.tocDepth != 1 || !ncx.tocNumbering {
+		t.Errorf("depth = %d, numbering = %v, want 1 and true", ncx.tocDepth, ncx.tocNumbering)
+	}
+	var buf bytes.Buffer
+	if err = ncx.WriteTocOverride(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "depth: 1\nnumbering: true\n") {
+		t.Errorf("WriteTocOverride() =\n%s", buf.String())
+	}
+}
+
+// TestTocOverrideRoundTrip edits the override printed by inspect, the TOC is the same without edits
+func TestTocOverrideRoundTrip(t *testing.T) {
+	spine := []string{"a", "b", "c", "n:no", "d"}
+	book := func() []*NavPoint {
+		a := nav("a.xhtml", nav("a.xhtml#1"))
+		a.Title, a.SubNavPoints[0].Title = "A", "Sec 1"
+		c := nav("c.xhtml")
+		c.Title = "C"
+		return []*NavPoint{a, c}
+	}
+	tests := []struct {
+		name   string
+		edit   func(string) string
+		want   string
+		hidden string
+	}{
+		{
+			name:   "unchanged",
+			edit:   func(s string) string { return s },
+			want:   "A(Sec 1 B heading) C D heading",
+			hidden: "N heading",
+		},
+		{
+			name: "hide a spine item missing in TOC",
+			edit: func(s string) string {
+				return strings.Replace(s, "href: b.xhtml\n", "href: b.xhtml\n    hide: true\n", 1)
+			},
+			want:   "A(Sec 1) C D heading",
+			hidden: "B heading N heading",
+		},
+		{
+			name:   "rename a spine item missing in TOC",
+			edit:   func(s string) string { return strings.Replace(s, "D heading", "Dee", 1) },
+			want:   "A(Sec 1 B heading) C Dee",
+			hidden: "N heading",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inspected := testBook(t, spine...)
+			inspected.NavMap = book()
+			inspected.MergeSpine(inspected.OPF)
+			var buf bytes.Buffer
+			if err := inspected.WriteTocOverride(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(buf.String(), "# TOC and spine differ:\n") {
+				t.Errorf("the report is not written as comments:\n%s", buf.String())
+			}
+			o, err := loadOverride(t, tt.edit(buf.String()))
+			if err != nil {
+				t.Fatalf("%s\n%s", err, buf.String())
+			}
+			ncx := testBook(t, spine...)
+			ncx.NavMap = book()
+			ncx.applyTocOverride(ncx.OPF, o)
+			ncx.MergeSpine(ncx.OPF)
+			if got := titles(ncx.NavMap); got != tt.want {
+				t.Errorf("NavMap = %s, want %s", got, tt.want)
+			}
+			if got := titles(ncx.Hidden); got != tt.hidden {
+				t.Errorf("Hidden = %s, want %s", got, tt.hidden)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package epub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+// epub:type and ARIA role of page break markers in content documents
+const (
+	pageBreakType = "pagebreak"
+	pageBreakRole = "doc-pagebreak"
+)
+
+// sentinels wrapping the page breaks in the text of search index
+const (
+	pageMarkStart = "\ue000"
+	pageMarkEnd   = "\ue001"
+)
+
+// PageTarget is a page of the print edition, from NCX pageList or EPUB 3 page-list nav
+type PageTarget struct {
+	Label   string  `xml:"navLabel>text"`
+	Content content `xml:"content"`
+
+	// Url is the output page with fragment, relative to the output directory
+	Url string `xml:"-"`
+	// Id is the unescaped fragment, empty when the target is the top of a content document
+	Id string `xml:"-"`
+}
+
+// PageOffset is a page break in the body of DocIndex, Offset counts UTF-16 code units like javascript strings
+type PageOffset struct {
+	Label  string `json:"label"`
+	Anchor string `json:"anchor,omitempty"`
+	Offset int    `json:"offset"`
+}
+
+// loadPageList reads the page-list nav of EPUB 3 when NCX has no pageList
+func (ncx *NCX) loadPageList(opf *OPF) {
+	if len(ncx.PageList) > 0 {
+		return
+	}
+	navDoc, relPath := ncx.navDocument(opf)
+	if navDoc == nil {
+		return
+	}
+	pageList := navDoc.findNav("page-list")
+	if pageList == nil || pageList.Item == nil {
+		return
+	}
+	for _, item := range pageList.Item.ItemInner {
+		ncx.PageList = append(ncx.PageList, &PageTarget{
+			Label: innerText(item.Anchor.Title),
+			Content: content{
+				Src: path.Join(relPath, item.Anchor.Href),
+			},
+		})
+	}
+}
+
+// initPageList resolves the output urls of page targets, it must be called after buildPagePaths
+func (ncx *NCX) initPageList() {
+	ncx.pageTargets = make(map[string][]*PageTarget)
+	var targets []*PageTarget
+	for _, pt := range ncx.PageList {
+		pt.Label = strings.TrimSpace(pt.Label)
+		doc := cleanHref(trimSharp(pt.Content.Src))
+		if pt.Label == "" || doc == "" {
+			continue
+		}
+		id, err := url.PathUnescape(strings.TrimPrefix(fragment(pt.Content.Src), "#"))
+		if err != nil {
+			id = strings.TrimPrefix(fragment(pt.Content.Src), "#")
+		}
+		pt.Id = id
+		pt.Url = ncx.partPath(doc, ncx.partOf(doc, pt.Content.Src)) + ncx.mergedSuffix(doc, fragment(pt.Content.Src))
+		ncx.pageTargets[doc] = append(ncx.pageTargets[doc], pt)
+		targets = append(targets, pt)
+	}
+	ncx.PageList = targets
+}
+
+// innerText returns the text of inner xml, like the label of a nav item
+func innerText(s string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(s))
+	if err != nil {
+		return s
+	}
+	return doc.Text()
+}
+
+// markPageBreaks marks the page targets of np and the page break markers without text with class epub-pagebreak,
+// the label is kept in data-page and shown in the margin
+func (np *NavPoint) markPageBreaks(doc *goquery.Document) {
+	body := doc.Find("body").First()
+	var top []*PageTarget
+	for _, docHref := range np.NCX.pageDocs(np.HtmlPath) {
+		for _, pt := range np.NCX.pageTargets[docHref] {
+			if np.NCX.partOf(docHref, pt.Content.Src) != np.Part {
+				continue
+			}
+			id := np.NCX.mergedTarget(docHref, pt.Id)
+			if id == "" {
+				top = append(top, pt)
+				continue
+			}
+			el := body.Find("[id]").FilterFunction(func(i int, s *goquery.Selection) bool {
+				return s.AttrOr("id", "") == id
+			}).First()
+			if el.Length() == 0 {
+				fmt.Fprintf(os.Stderr, "warnning: target of page %s is not found in %s\n", pt.Label, docHref)
+				continue
+			}
+			el.AddClass("epub-pagebreak").SetAttr("data-page", pt.Label)
+		}
+	}
+	body.Find("[data-epub-type], [role]").Each(func(i int, s *goquery.Selection) {
+		if !hasToken(s, "data-epub-type", pageBreakType) && !hasToken(s, "role", pageBreakRole) {
+			return
+		}
+		if _, ok := s.Attr("data-page"); ok || strings.TrimSpace(s.Text()) != "" {
+			return
+		}
+		if label := strings.TrimSpace(firstNonEmpty(s.AttrOr("title", ""), s.AttrOr("aria-label", ""))); label != "" {
+			s.AddClass("epub-pagebreak").SetAttr("data-page", label)
+		}
+	})
+	for i := len(top) - 1; i >= 0; i-- {
+		body.PrependNodes(&html.Node{Type: html.ElementNode, Data: "span", Attr: []html.Attribute{
+			{Key: "class", Val: "epub-pagebreak"},
+			{Key: "data-page", Val: top[i].Label},
+		}})
+	}
+}
+
+// HasPageList reports whether the book has pages of the print edition
+func (ncx *NCX) HasPageList() bool {
+	return len(ncx.PageList) > 0
+}
+
+// indexPages returns the text of body for search, and the offsets of page breaks in it
+func indexPages(body *goquery.Selection) (string, []*PageOffset) {
+	var labels []*PageOffset
+	body.Find(".epub-pagebreak").Each(func(i int, s *goquery.Selection) {
+		labels = append(labels, &PageOffset{Label: s.AttrOr("data-page", ""), Anchor: s.AttrOr("id", "")})
+		s.PrependHtml(fmt.Sprintf("%s%d%s", pageMarkStart, i, pageMarkEnd))
+	})
+	text := body.Text()
+	if len(labels) == 0 {
+		return text, nil
+	}
+	var buf strings.Builder
+	var pages []*PageOffset
+	offset := 0
+	for {
+		start := strings.Index(text, pageMarkStart)
+		if start == -1 {
+			break
+		}
+		end := strings.Index(text[start:], pageMarkEnd)
+		if end == -1 {
+			break
+		}
+		buf.WriteString(text[:start])
+		offset += len(utf16.Encode([]rune(text[:start])))
+		var i int
+		if _, err := fmt.Sscanf(text[start+len(pageMarkStart):start+end], "%d", &i); err == nil && i < len(labels) {
+			labels[i].Offset = offset
+			pages = append(pages, labels[i])
+		}
+		text = text[start+end+len(pageMarkEnd):]
+	}
+	buf.WriteString(text)
+	return buf.String(), pages
+}
+
+// WritePageList saves page labels and their urls for "go to page" of navigation
+func (ncx *NCX) WritePageList() error {
+	if !ncx.HasPageList() {
+		return nil
+	}
+	type page struct {
+		Label string `json:"label"`
+		Url   string `json:"url"`
+	}
+	var pages []page
+	for _, pt := range ncx.PageList {
+		pages = append(pages, page{Label: pt.Label, Url: pt.Url})
+	}
+	data, err := json.Marshal(pages)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(ncx.OutDir, "page_list.json"), data, 0644)
+}
@@ -0,0 +1,256 @@
+package epub
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// linkAttrs lists the attributes rewritten in content documents,
+// attribute "href" of svg elements matches "xlink:href" too, both of them are rewritten
+var linkAttrs = []struct {
+	// Tag is case sensitive for svg elements, like feImage
+	Tag  string
+	Attr string
+	Page bool
+}{
+	{"a", "href", true},
+	{"area", "href", true},
+	{"img", "src", false},
+	{"image", "href", false},
+	{"use", "href", false},
+	{"feImage", "href", false},
+	{"audio", "src", false},
+	{"video", "src", false},
+	{"video", "poster", false},
+	{"source", "src", false},
+	{"track", "src", false},
+	{"embed", "src", false},
+	{"object", "data", false},
+	{"link", "href", false},
+}
+
+func (ncx *NCX) indexManifest(opf *OPF) {
+	ncx.manifestItems = make(map[string]*ManifestItem)
+	for _, m := range opf.Manifests {
+		ncx.manifestItems[cleanHref(m.Href)] = m
+	}
+	ncx.itemRefs = make(map[string]*ItemRef)
+	for _, item := range opf.Spine.ItemRefs {
+		if mf := opf.findRenderable(opf.findManifestItem(item.Idref)); mf != nil {
+			ncx.itemRefs[cleanHref(mf.Href)] = item
+		}
+	}
+}
+
+// mediaType returns the media type of manifest resource href,
+// the media type of resource missing in manifest is guessed from its extension
+func (ncx *NCX) mediaType(href string) string {
+	if m, ok := ncx.manifestItems[cleanHref(href)]; ok {
+		return m.MediaType
+	}
+	switch ext := strings.ToLower(path.Ext(href)); ext {
+	case ".xhtml":
+		return MediaTypeHTML
+	case ".html", ".htm":
+		return MediaTypeTextHTML
+	default:
+		return mime.TypeByExtension(ext)
+	}
+}
+
+// ResolvePage returns the url of ref found in manifest resource docHref,
+// relative to outPath in the output directory.
+// Links to content documents are resolved to their output pages, others are resolved like ResolveAsset.
+func (ncx *NCX) ResolvePage(docHref, outPath, ref string) (string, bool) {
+	// fragments of a split document may be in another part of it
+	if strings.HasPrefix(ref, "#") && len(ncx.splitParts[docHref]) > 0 {
+		ref = (&url.URL{Path: path.Base(docHref)}).EscapedPath() + ref
+	}
+	if isExternalRef(ref) {
+		return ref, true
+	}
+	target, suffix := resolveRef(docHref, ref)
+	if target == "" {
+		return ref, true
+	}
+	if page, ok := ncx.pagePaths[target]; ok {
+		_, merged := ncx.mergeGroups[target]
+		if len(ncx.splitParts[target]) > 0 || merged {
+			page = ncx.partPath(target, ncx.partOf(target, suffix))
+			suffix = ncx.mergedSuffix(target, suffix)
+			// a page holding several documents or parts of one jumps to its own targets
+			if page == outPath && fragment(suffix) != "" {
+				return fragment(suffix), true
+			}
+		}
+		if !ncx.isRendered(page) {
+			return ref, false
+		}
+		return relativeUrl(path.Dir(outPath), page) + suffix, true
+	}
+	return ncx.ResolveAsset(docHref, outPath, ref)
+}
+
+// ResolveAsset returns the url of resource ref found in manifest resource docHref,
+// relative to outPath in the output directory.
+func (ncx *NCX) ResolveAsset(docHref, outPath, ref string) (string, bool) {
+	if isExternalRef(ref) {
+		return ref, true
+	}
+	target, suffix := resolveRef(docHref, ref)
+	if target == "" {
+		return ref, true
+	}
+	out, ok := ncx.assetPath(target)
+	if !ok {
+		return ref, false
+	}
+	return relativeUrl(path.Dir(outPath), out) + suffix, true
+}
+
+// assetPath returns the path of a manifest resource in the output directory
+func (ncx *NCX) assetPath(manifestPath string) (string, bool) {
+	manifestPath = path.Clean(manifestPath)
+	if m, ok := ncx.manifestItems[manifestPath]; ok {
+		if m.MediaType == MediaTypeHTML {
+			if p := ncx.pagePath(manifestPath); ncx.isRendered(p) {
+				return p, true
+			}
+			return "", false
+		}
+		return manifestPath, true
+	}
+	// resources missing in manifest are copied as is
+	if _, err := os.Stat(path.Join(ncx.WorkDir, manifestPath)); err == nil {
+		return manifestPath, true
+	}
+	return "", false
+}
+
+// rewriteLinks rewrites all links and resources in the content of np to their output urls
+func (np *NavPoint) rewriteLinks(doc *goquery.Document) {
+	np.NCX.rewriteRefs(doc.Find("body"), cleanHref(np.HtmlPath), np.Src)
+}
+
+// rewriteRefs rewrites links and resources under s, which is a part of manifest resource docHref,
+// to urls relative to outPath in the output directory
+func (ncx *NCX) rewriteRefs(s *goquery.Selection, docHref, outPath string) {
+	report := func(ref string) {
+		fmt.Fprintf(os.Stderr, "warnning: unresolved link %s in %s\n", ref, docHref)
+	}
+	for _, la := range linkAttrs {
+		resolve := ncx.ResolveAsset
+		if la.Page {
+			resolve = ncx.ResolvePage
+		}
+		s.Find("*").FilterFunction(func(i int, s *goquery.Selection) bool {
+			return goquery.NodeName(s) == la.Tag
+		}).Each(func(i int, s *goquery.Selection) {
+			n := s.Get(0)
+			for i, a := range n.Attr {
+				if a.Key != la.Attr {
+					continue
+				}
+				newRef, ok := resolve(docHref, outPath, a.Val)
+				if !ok {
+					report(a.Val)
+				}
+				n.Attr[i].Val = newRef
+			}
+		})
+	}
+	s.Find("img[srcset], source[srcset]").Each(func(i int, s *goquery.Selection) {
+		srcset, _ := s.Attr("srcset")
+		var candidates []string
+		for _, candidate := range strings.Split(srcset, ",") {
+			fields := strings.Fields(candidate)
+			if len(fields) == 0 {
+				continue
+			}
+			newRef, ok := ncx.ResolveAsset(docHref, outPath, fields[0])
+			if !ok {
+				report(fields[0])
+			}
+			fields[0] = newRef
+			candidates = append(candidates, strings.Join(fields, " "))
+		}
+		s.SetAttr("srcset", strings.Join(candidates, ", "))
+	})
+	// url() in inline styles, like background images
+	s.Find("[style]").AddSelection(s.Filter("[style]")).Each(func(i int, s *goquery.Selection) {
+		s.SetAttr("style", ncx.rewriteCss(s.AttrOr("style", ""), docHref, outPath))
+	})
+}
+
+// resolveRef returns the manifest path of ref found in manifest resource docHref,
+// and the rest of ref, like "?x#y"
+func resolveRef(docHref, ref string) (string, string) {
+	target, suffix := splitRef(ref)
+	if target == "" {
+		return "", suffix
+	}
+	return path.Join(path.Dir(docHref), cleanHref(target)), suffix
+}
+
+// isExternalRef reports whether ref points outside of the book
+func isExternalRef(ref string) bool {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || path.IsAbs(ref) || strings.HasPrefix(ref, "#") || strings.HasPrefix(ref, "//") {
+		return true
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return false
+	}
+	return u.Scheme != ""
+}
+
+// splitRef splits "a.png?x#y" into "a.png" and "?x#y"
+func splitRef(ref string) (string, string) {
+	idx := strings.IndexAny(ref, "?#")
+	if idx == -1 {
+		return ref, ""
+	}
+	return ref[:idx], ref[idx:]
+}
+
+// cleanHref unescapes and cleans a href relative to the directory of OPF
+func cleanHref(href string) string {
+	unescaped, err := url.PathUnescape(href)
+	if err != nil {
+		unescaped = href
+	}
+	return path.Clean(unescaped)
+}
+
+// relativeUrl returns the url of target relative to a page or style in fromDir,
+// both fromDir and target are relative to the output directory
+func relativeUrl(fromDir, target string) string {
+	fromParts := splitPath(fromDir)
+	targetParts := splitPath(target)
+	i := 0
+	for i < len(fromParts) && i < len(targetParts)-1 && fromParts[i] == targetParts[i] {
+		i++
+	}
+	var parts []string
+	for range fromParts[i:] {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, targetParts[i:]...)
+	rel := strings.Join(parts, "/")
+	return (&url.URL{Path: rel}).EscapedPath()
+}
+
+func splitPath(p string) []string {
+	p = path.Clean(p)
+	if p == "." || p == "/" {
+		return nil
+	}
+	return strings.Split(strings.Trim(p, "/"), "/")
+}
@@ -0,0 +1,221 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// namespaces found in content documents, undeclared prefixes are accepted too
+const (
+	nsXHTML  = "http://www.w3.org/1999/xhtml"
+	nsSVG    = "http://www.w3.org/2000/svg"
+	nsMathML = "http://www.w3.org/1998/Math/MathML"
+	nsXLink  = "http://www.w3.org/1999/xlink"
+	nsXML    = "http://www.w3.org/XML/1998/namespace"
+	nsOPS    = "http://www.idpf.org/2007/ops"
+)
+
+// parseContent parses a content document into an HTML5 tree.
+// XHTML is parsed as XML, so self-closing tags and namespaces survive, and falls back to HTML when it is malformed.
+// EPUB attributes like epub:type are kept as data-epub-type.
+func parseContent(r io.Reader, isXHTML bool, name string) (*goquery.Document, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if isXHTML {
+		root, err := parseXHTML(data)
+		if err == nil {
+			return goquery.NewDocumentFromNode(root), nil
+		}
+		fmt.Fprintf(os.Stderr, "warnning: %s is not well-formed XHTML, parsed as HTML: %s\n", name, err)
+	}
+	root, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	normalizeHTML(root)
+	return goquery.NewDocumentFromNode(root), nil
+}
+
+// contentDocument returns the parsed content document href, documents are cached for all pages
+func (ncx *NCX) contentDocument(href string) *goquery.Document {
+	if doc, ok := ncx.contentDocs[href]; ok {
+		return doc
+	}
+	doc, err := ncx.parseDocument(href)
+	if err != nil {
+		doc = nil
+	}
+	if ncx.contentDocs == nil {
+		ncx.contentDocs = make(map[string]*goquery.Document)
+	}
+	ncx.contentDocs[href] = doc
+	return doc
+}
+
+// parseDocument parses content document href, unlike contentDocument the result is not cached and can be changed
+func (ncx *NCX) parseDocument(href string) (*goquery.Document, error) {
+	f, err := ncx.openDocument(href)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseContent(f, ncx.mediaType(href) == MediaTypeHTML, href)
+}
+
+// openDocument opens content document href, the pages generated by the converter are built in memory
+func (ncx *NCX) openDocument(href string) (io.ReadCloser, error) {
+	if l, ok := ncx.generatedLists[cleanHref(href)]; ok {
+		return ioutil.NopCloser(strings.NewReader(l.document())), nil
+	}
+	return os.Open(path.Join(ncx.WorkDir, href))
+}
+
+// parseXHTML builds the HTML5 tree of an XHTML document
+func parseXHTML(data []byte) (*html.Node, error) {
+	root, err := parseXML(data)
+	if err != nil {
+		return nil, err
+	}
+	if goquery.NewDocumentFromNode(root).Find("body").Length() == 0 {
+		return nil, errors.New("body not found")
+	}
+	return root, nil
+}
+
+// parseXML builds the HTML5 tree of an XML document, like XHTML or SVG
+func parseXML(data []byte) (*html.Node, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	root := &html.Node{Type: html.DocumentNode}
+	stack := []*html.Node{root}
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		top := stack[len(stack)-1]
+		switch t := token.(type) {
+		case xml.StartElement:
+			n := convertElement(t)
+			top.AppendChild(n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if top != root {
+				top.AppendChild(&html.Node{Type: html.TextNode, Data: string(t)})
+			}
+		case xml.Comment:
+			top.AppendChild(&html.Node{Type: html.CommentNode, Data: string(t)})
+		}
+	}
+	return root, nil
+}
+
+func convertElement(t xml.StartElement) *html.Node {
+	n := &html.Node{Type: html.ElementNode}
+	switch t.Name.Space {
+	case nsSVG, "svg":
+		n.Namespace, n.Data = "svg", t.Name.Local
+	case nsMathML, "m", "mml", "math":
+		n.Namespace, n.Data = "math", t.Name.Local
+	case nsOPS, "epub":
+		// epub:switch and friends are unknown elements of HTML
+		n.Data = "epub:" + t.Name.Local
+	default:
+		n.Data = strings.ToLower(t.Name.Local)
+		n.DataAtom = atom.Lookup([]byte(n.Data))
+	}
+	seen := make(map[string]bool)
+	for _, a := range t.Attr {
+		attr, ok := convertAttr(n, a)
+		if !ok || seen[attr.Namespace+":"+attr.Key] {
+			continue
+		}
+		seen[attr.Namespace+":"+attr.Key] = true
+		n.Attr = append(n.Attr, attr)
+	}
+	return n
+}
+
+// convertAttr maps a namespaced XML attribute to HTML5, ok is false when the attribute is dropped
+func convertAttr(n *html.Node, a xml.Attr) (attr html.Attribute, ok bool) {
+	foreign := n.Namespace != ""
+	switch a.Name.Space {
+	case "":
+		if a.Name.Local == "xmlns" {
+			return attr, false
+		}
+		return html.Attribute{Key: a.Name.Local, Val: a.Value}, true
+	case "xmlns":
+		return attr, false
+	case nsXML, "xml":
+		if foreign {
+			return html.Attribute{Namespace: "xml", Key: a.Name.Local, Val: a.Value}, true
+		}
+		// xml:lang is lang in HTML, xml:space and xml:base have no meaning
+		if a.Name.Local == "lang" {
+			return html.Attribute{Key: "lang", Val: a.Value}, true
+		}
+		return attr, false
+	case nsXLink, "xlink":
+		if foreign {
+			return html.Attribute{Namespace: "xlink", Key: a.Name.Local, Val: a.Value}, true
+		}
+		return html.Attribute{Key: "data-xlink-" + a.Name.Local, Val: a.Value}, true
+	case nsOPS, "epub":
+		return html.Attribute{Key: "data-epub-" + a.Name.Local, Val: a.Value}, true
+	default:
+		return html.Attribute{Key: "data-" + a.Name.Local, Val: a.Value}, true
+	}
+}
+
+// normalizeHTML renames the EPUB attributes of a document parsed as HTML like parseXHTML does
+func normalizeHTML(n *html.Node) {
+	if n.Type == html.ElementNode && n.Namespace == "" {
+		var attrs []html.Attribute
+		hasLang := false
+		for _, a := range n.Attr {
+			hasLang = hasLang || a.Key == "lang"
+		}
+		for _, a := range n.Attr {
+			switch {
+			case a.Key == "xmlns" || strings.HasPrefix(a.Key, "xmlns:"):
+				continue
+			case a.Key == "xml:lang":
+				if hasLang {
+					continue
+				}
+				a.Key, hasLang = "lang", true
+			case strings.HasPrefix(a.Key, "epub:"):
+				a.Key = "data-epub-" + strings.TrimPrefix(a.Key, "epub:")
+			}
+			attrs = append(attrs, a)
+		}
+		n.Attr = attrs
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		normalizeHTML(c)
+	}
+}
@@ -0,0 +1,75 @@
+package epub
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// TestParseContent parses testdata/*.xhtml and compares the HTML5 output with the golden .html files
+func TestParseContent(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.xhtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no testdata")
+	}
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".xhtml")
+		t.Run(name, func(t *testing.T) {
+			f, err := os.Open(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			doc, err := parseContent(f, true, input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err = html.Render(&buf, doc.Nodes[0]); err != nil {
+				t.Fatal(err)
+			}
+			buf.WriteString("\n")
+			golden := filepath.Join("testdata", name+".html")
+			if *update {
+				if err = ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != string(want) {
+				t.Errorf("%s:\ngot:\n%s\nwant:\n%s", input, got, want)
+			}
+		})
+	}
+}
+
+// TestParseContentFallback checks that malformed XHTML is parsed as HTML, with the EPUB attributes renamed
+func TestParseContentFallback(t *testing.T) {
+	doc, err := parseContent(strings.NewReader(`<html xml:lang="en"><body><p epub:type="pagebreak">a<b>b</p></i></body></html>`), true, "bad.xhtml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := doc.Find("html").AttrOr("lang", ""); got != "en" {
+		t.Errorf("lang = %q, want %q", got, "en")
+	}
+	if got := doc.Find("p").AttrOr("data-epub-type", ""); got != "pagebreak" {
+		t.Errorf("data-epub-type = %q, want %q", got, "pagebreak")
+	}
+	if got := doc.Find("body").Text(); got != "ab" {
+		t.Errorf("text = %q, want %q", got, "ab")
+	}
+}
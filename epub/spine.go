@@ -0,0 +1,288 @@
+package epub
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// MergeReport lists the discrepancies between TOC and spine found by MergeSpine
+type MergeReport struct {
+	// Missing are the linear spine items missing in TOC, they are inserted by reading order
+	Missing []string
+	// NonLinear are the non-linear spine items missing in TOC
+	NonLinear []string
+	// NotInSpine are the documents of TOC entries missing in spine
+	NotInSpine []string
+	// OutOfOrder are the documents of TOC entries before the ones preceding them in spine
+	OutOfOrder []string
+	// Duplicated are the spine items referenced more than once, only the first one is kept
+	Duplicated []string
+}
+
+// Empty reports whether TOC and spine agree
+func (r *MergeReport) Empty() bool {
+	return len(r.Missing) == 0 && len(r.NonLinear) == 0 && len(r.NotInSpine) == 0 &&
+		len(r.OutOfOrder) == 0 && len(r.Duplicated) == 0
+}
+
+func (r *MergeReport) String() string {
+	var buf strings.Builder
+	buf.WriteString("TOC and spine differ:\n")
+	for _, l := range []struct {
+		title string
+		docs  []string
+	}{
+		{"spine items missing in TOC, inserted by reading order", r.Missing},
+		{"non-linear spine items missing in TOC", r.NonLinear},
+		{"TOC entries missing in spine", r.NotInSpine},
+		{"TOC entries out of spine order", r.OutOfOrder},
+		{"spine items referenced more than once", r.Duplicated},
+	} {
+		if len(l.docs) > 0 {
+			fmt.Fprintf(&buf, "  %s: %s\n", l.title, strings.Join(l.docs, ", "))
+		}
+	}
+	return buf.String()
+}
+
+// sortByPlayOrder sorts nav points of NCX by playOrder, the siblings without playOrder keep their order
+func sortByPlayOrder(navs []*NavPoint) {
+	ordered := true
+	for _, nav := range navs {
+		sortByPlayOrder(nav.SubNavPoints)
+		ordered = ordered && nav.PlayOrder > 0
+	}
+	if !ordered {
+		return
+	}
+	sort.SliceStable(navs, func(i, j int) bool {
+		return navs[i].PlayOrder < navs[j].PlayOrder
+	})
+}
+
+// MergeSpine inserts the spine items missing in TOC, a missing linear item follows the entries of
+// the linear item before it in spine, so TOC keeps the reading order. Non-linear items go to the appendix or hidden pages.
+// Prev and next navigation follows spine by buildReadingOrder, each linear page is read once whatever TOC is.
+func (ncx *NCX) MergeSpine(opf *OPF) {
+	report := &MergeReport{}
+	ncx.Report = report
+	// document -> nav point, hidden pages are out of navigation on purpose
+	cacheMap := make(map[string]*NavPoint)
+	buildCacheMap(cacheMap, ncx.NavMap)
+	buildCacheMap(cacheMap, ncx.Hidden)
+	// document -> position in spine, foreign documents are mapped to their fallbacks
+	spineIndex := make(map[string]int)
+	// documents out of reading order
+	nonLinearDocs := make(map[string]bool)
+	var nonLinear []*NavPoint
+	prev := ""
+	for _, item := range opf.Spine.ItemRefs {
+		mf := opf.findManifestItem(item.Idref)
+		if mf == nil {
+			continue
+		}
+		rendered := opf.findRenderable(mf)
+		if rendered == nil {
+			fmt.Fprintf(os.Stderr, "warnning: spine item %s (%s) has no renderable fallback, skipped\n", mf.Href, mf.MediaType)
+			continue
+		}
+		key := cacheKey(rendered.Href)
+		if _, ok := spineIndex[key]; ok {
+			report.Duplicated = append(report.Duplicated, mf.Href)
+			continue
+		}
+		spineIndex[key] = len(spineIndex)
+		spineIndex[cacheKey(mf.Href)] = spineIndex[key]
+		if !item.isLinear() {
+			nonLinearDocs[key], nonLinearDocs[cacheKey(mf.Href)] = true, true
+		}
+		_, ok := cacheMap[key]
+		if !ok {
+			_, ok = cacheMap[cacheKey(mf.Href)]
+		}
+		if ok {
+			if item.isLinear() {
+				prev = key
+			}
+			continue
+		}
+		nav := &NavPoint{
+			// Spine page may not contain right title, try to find from H1, H2, H3 tag
+			Title: ncx.findSpineTitle(rendered, findHTitle),
+			Content: content{
+				Src: rendered.Href,
+			},
+		}
+		cacheMap[key] = nav
+		if !item.isLinear() {
+			// non-linear pages are not a part of reading order, keep them out of the tree
+			report.NonLinear = append(report.NonLinear, rendered.Href)
+			nonLinear = append(nonLinear, nav)
+			continue
+		}
+		report.Missing = append(report.Missing, rendered.Href)
+		ncx.NavMap = insertAfterDoc(ncx.NavMap, prev, nav)
+		prev = key
+	}
+	ncx.checkOrder(spineIndex, nonLinearDocs)
+	if !report.Empty() {
+		fmt.Fprintf(os.Stderr, "warnning: %s", report)
+	}
+	if len(nonLinear) == 0 {
+		return
+	}
+	if ncx.Options.Appendix {
+		ncx.NavMap = append(ncx.NavMap, &NavPoint{
+			Title: "Appendix",
+			Content: content{
+				Src: nonLinear[0].Content.Src,
+			},
+			SubNavPoints: nonLinear,
+			Group:        true,
+		})
+	} else {
+		ncx.Hidden = append(ncx.Hidden, nonLinear...)
+	}
+}
+
+// checkOrder reports the TOC entries missing in spine, or linear ones out of spine order
+func (ncx *NCX) checkOrder(spineIndex map[string]int, nonLinearDocs map[string]bool) {
+	reported := make(map[string]bool)
+	last, lastDoc := -1, ""
+	for _, f := range flattenNavs(ncx.NavMap, nil) {
+		if f.nav.Group {
+			continue
+		}
+		doc := cacheKey(f.nav.Content.Src)
+		idx, ok := spineIndex[doc]
+		switch {
+		case reported[doc] || nonLinearDocs[doc]:
+			continue
+		case !ok:
+			ncx.Report.NotInSpine = append(ncx.Report.NotInSpine, doc)
+			reported[doc] = true
+		case idx < last && doc != lastDoc:
+			ncx.Report.OutOfOrder = append(ncx.Report.OutOfOrder, doc)
+			reported[doc] = true
+		}
+		if ok && idx > last {
+			last = idx
+		}
+		lastDoc = doc
+	}
+}
+
+type flatNav struct {
+	nav    *NavPoint
+	parent *NavPoint
+}
+
+// flattenNavs returns nav points in pre-order with their parents
+func flattenNavs(navs []*NavPoint, parent *NavPoint) []flatNav {
+	var flat []flatNav
+	for _, nav := range navs {
+		flat = append(flat, flatNav{nav: nav, parent: parent})
+		flat = append(flat, flattenNavs(nav.SubNavPoints, nav)...)
+	}
+	return flat
+}
+
+// insertAfterDoc inserts nav right after the entries of document doc in pre-order,
+// it is the first child of the last entry if the entry has children, or the next sibling of it.
+// nav is the first entry when doc is empty.
+func insertAfterDoc(navs []*NavPoint, doc string, nav *NavPoint) []*NavPoint {
+	if doc == "" {
+		return append([]*NavPoint{nav}, navs...)
+	}
+	flat := flattenNavs(navs, nil)
+	last := -1
+	for i, f := range flat {
+		if f.nav.Group || cacheKey(f.nav.Content.Src) != doc {
+			if last != -1 {
+				break
+			}
+			continue
+		}
+		last = i
+	}
+	if last == -1 {
+		return append(navs, nav)
+	}
+	after := flat[last]
+	if len(after.nav.SubNavPoints) > 0 {
+		after.nav.SubNavPoints = append([]*NavPoint{nav}, after.nav.SubNavPoints...)
+		return navs
+	}
+	if after.parent == nil {
+		return insertNav(navs, after.nav, nav)
+	}
+	after.parent.SubNavPoints = insertNav(after.parent.SubNavPoints, after.nav, nav)
+	return navs
+}
+
+// insertNav inserts nav into navs after the sibling
+func insertNav(navs []*NavPoint, sibling, nav *NavPoint) []*NavPoint {
+	for i, v := range navs {
+		if v == sibling {
+			return append(navs[:i+1], append([]*NavPoint{nav}, navs[i+1:]...)...)
+		}
+	}
+	return append(navs, nav)
+}
+
+// buildReadingOrder links the pages by spine for prev and next navigation, it must be called after UpdateNavMap.
+// Linear pages out of spine, like the generated lists, follow the page before them in TOC.
+func (ncx *NCX) buildReadingOrder(opf *OPF) {
+	first := make(map[string]*NavPoint)
+	var chain []*NavPoint
+	for _, np := range ncx.pages() {
+		if _, ok := first[np.Src]; !ok {
+			first[np.Src] = np
+			chain = append(chain, np)
+		}
+	}
+	inOrder := make(map[*NavPoint]bool)
+	var spine []*NavPoint
+	for _, item := range opf.Spine.ItemRefs {
+		mf := opf.findRenderable(opf.findManifestItem(item.Idref))
+		if mf == nil || !item.isLinear() {
+			continue
+		}
+		for _, p := range ncx.pagePathsOf(mf.Href) {
+			if np, ok := first[p]; ok && !inOrder[np] {
+				inOrder[np] = true
+				spine = append(spine, np)
+			}
+		}
+	}
+	hidden := make(map[*NavPoint]bool)
+	for _, np := range ncx.Hidden {
+		hidden[np] = true
+	}
+	var leading []*NavPoint
+	attached := make(map[*NavPoint][]*NavPoint)
+	var anchor *NavPoint
+	for _, np := range chain {
+		switch {
+		case inOrder[np]:
+			anchor = np
+		case np.NonLinear || hidden[np]:
+		case anchor == nil:
+			leading = append(leading, np)
+		default:
+			attached[anchor] = append(attached[anchor], np)
+		}
+	}
+	order := leading
+	for _, np := range spine {
+		order = append(order, np)
+		order = append(order, attached[np]...)
+	}
+	ncx.readingOrder = order
+	ncx.readingIndex = make(map[string]int)
+	for i, np := range order {
+		ncx.readingIndex[np.Src] = i
+	}
+}
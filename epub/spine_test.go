@@ -0,0 +1,367 @@
+package epub
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// nav returns a nav point of src with sub nav points
+func nav(src string, subs ...*NavPoint) *NavPoint {
+	return &NavPoint{Title: src, Content: content{Src: src}, SubNavPoints: subs}
+}
+
+// ordered returns a nav point of src with playOrder
+func ordered(src string, playOrder int, subs ...*NavPoint) *NavPoint {
+	np := nav(src, subs...)
+	np.PlayOrder = playOrder
+	return np
+}
+
+// tree returns navs like "a(b c) d", groups are shown by their titles in brackets
+func tree(navs []*NavPoint) string {
+	var parts []string
+	for _, np := range navs {
+		s := np.Content.Src
+		if np.Group {
+			s = "[" + np.Title + "]"
+		}
+		if len(np.SubNavPoints) > 0 {
+			s += "(" + tree(np.SubNavPoints) + ")"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " ")
+}
+
+// testBook writes a book with the spine items, like "a", or "n:no" for a non-linear item,
+// or "f>c" for a foreign item with fallback c. Every document has the h1 "<ID> heading".
+func testBook(t *testing.T, spine ...string) *NCX {
+	dir := t.TempDir()
+	opf := &OPF{}
+	added := make(map[string]bool)
+	add := func(id, href, mediaType, fallback string) {
+		if added[id] {
+			return
+		}
+		added[id] = true
+		opf.Manifests = append(opf.Manifests, &ManifestItem{Id: id, Href: href, MediaType: mediaType, Fallback: fallback})
+		if mediaType != MediaTypeHTML {
+			return
+		}
+		doc := fmt.Sprintf(`<html xmlns="http://www.w3.org/1999/xhtml"><head><title>%s</title></head><body><h1>%s heading</h1></body></html>`,
+			id, strings.ToUpper(id))
+		if err := ioutil.WriteFile(path.Join(dir, href), []byte(doc), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range spine {
+		item := &ItemRef{}
+		if strings.HasSuffix(s, ":no") {
+			s = strings.TrimSuffix(s, ":no")
+			item.Linear = "no"
+		}
+		if ids := strings.Split(s, ">"); len(ids) == 2 {
+			add(ids[1], ids[1]+".xhtml", MediaTypeHTML, "")
+			add(ids[0], ids[0]+".foo", "application/x-foo", ids[1])
+			s = ids[0]
+		} else {
+			add(s, s+".xhtml", MediaTypeHTML, "")
+		}
+		item.Idref = s
+		opf.Spine.ItemRefs = append(opf.Spine.ItemRefs, item)
+	}
+	ncx := &NCX{WorkDir: dir, OPF: opf}
+	ncx.indexManifest(opf)
+	return ncx
+}
+
+func TestInsertAfterDoc(t *testing.T) {
+	tests := []struct {
+		name string
+		navs []*NavPoint
+		doc  string
+		want string
+	}{
+		{
+			name: "next sibling",
+			navs: []*NavPoint{nav("a.xhtml"), nav("b.xhtml")},
+			doc:  "a.xhtml",
+			want: "a.xhtml x.xhtml b.xhtml",
+		},
+		{
+			name: "previous doc has children",
+			navs: []*NavPoint{nav("a.xhtml", nav("b.xhtml")), nav("c.xhtml")},
+			doc:  "a.xhtml",
+			want: "a.xhtml(x.xhtml b.xhtml) c.xhtml",
+		},
+		{
+			name: "after the last entry of previous doc",
+			navs: []*NavPoint{nav("a.xhtml", nav("a.xhtml#1"), nav("a.xhtml#2")), nav("b.xhtml")},
+			doc:  "a.xhtml",
+			want: "a.xhtml(a.xhtml#1 a.xhtml#2 x.xhtml) b.xhtml",
+		},
+		{
+			name: "groups are skipped",
+			navs: []*NavPoint{{Title: "g", Content: content{Src: "a.xhtml"}, SubNavPoints: []*NavPoint{nav("b.xhtml")}, Group: true}},
+			doc:  "a.xhtml",
+			want: "[g](b.xhtml) x.xhtml",
+		},
+		{
+			name: "previous doc only in hidden",
+			navs: []*NavPoint{nav("a.xhtml"), nav("b.xhtml")},
+			doc:  "h.xhtml",
+			want: "a.xhtml b.xhtml x.xhtml",
+		},
+		{
+			name: "empty previous doc",
+			navs: []*NavPoint{nav("a.xhtml"), nav("b.xhtml")},
+			doc:  "",
+			want: "x.xhtml a.xhtml b.xhtml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tree(insertAfterDoc(tt.navs, tt.doc, nav("x.xhtml")))
+			if got != tt.want {
+				t.Errorf("insertAfterDoc() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortByPlayOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		navs []*NavPoint
+		want string
+	}{
+		{
+			name: "all siblings have playOrder",
+			navs: []*NavPoint{ordered("c", 3), ordered("a", 1), ordered("b", 2)},
+			want: "a b c",
+		},
+		{
+			name: "partial playOrder keeps the order",
+			navs: []*NavPoint{ordered("c", 3), nav("a"), ordered("b", 2)},
+			want: "c a b",
+		},
+		{
+			name: "children are sorted by themselves",
+			navs: []*NavPoint{nav("a", ordered("a2", 3), ordered("a1", 2)), ordered("b", 1)},
+			want: "a(a1 a2) b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sortByPlayOrder(tt.navs)
+			if got := tree(tt.navs); got != tt.want {
+				t.Errorf("sortByPlayOrder() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeSpine(t *testing.T) {
+	tests := []struct {
+		name     string
+		spine    []string
+		navs     []*NavPoint
+		appendix bool
+		want     string
+		hidden   string
+		report   MergeReport
+	}{
+		{
+			name:   "missing items follow the previous item",
+			spine:  []string{"a", "b", "c"},
+			navs:   []*NavPoint{nav("c.xhtml")},
+			want:   "a.xhtml b.xhtml c.xhtml",
+			report: MergeReport{Missing: []string{"a.xhtml", "b.xhtml"}},
+		},
+		{
+			name:   "duplicated spine items",
+			spine:  []string{"a", "b", "a"},
+			navs:   []*NavPoint{nav("a.xhtml")},
+			want:   "a.xhtml b.xhtml",
+			report: MergeReport{Missing: []string{"b.xhtml"}, Duplicated: []string{"a.xhtml"}},
+		},
+		{
+			name:   "non-linear items are hidden",
+			spine:  []string{"a", "n:no", "b"},
+			navs:   []*NavPoint{nav("a.xhtml"), nav("b.xhtml")},
+			want:   "a.xhtml b.xhtml",
+			hidden: "n.xhtml",
+			report: MergeReport{NonLinear: []string{"n.xhtml"}},
+		},
+		{
+			name:     "non-linear items go to appendix",
+			spine:    []string{"a", "n:no", "m:no"},
+			navs:     []*NavPoint{nav("a.xhtml")},
+			appendix: true,
+			want:     "a.xhtml [Appendix](n.xhtml m.xhtml)",
+			report:   MergeReport{NonLinear: []string{"n.xhtml", "m.xhtml"}},
+		},
+		{
+			name:   "foreign items are replaced by fallbacks",
+			spine:  []string{"a", "f>c", "b"},
+			navs:   []*NavPoint{nav("a.xhtml"), nav("b.xhtml")},
+			want:   "a.xhtml c.xhtml b.xhtml",
+			report: MergeReport{Missing: []string{"c.xhtml"}},
+		},
+		{
+			name:  "foreign items in TOC",
+			spine: []string{"a", "f>c"},
+			navs:  []*NavPoint{nav("a.xhtml"), nav("f.foo")},
+			want:  "a.xhtml f.foo",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ncx := testBook(t, tt.spine...)
+			ncx.NavMap = tt.navs
+			ncx.Options.Appendix = tt.appendix
+			ncx.MergeSpine(ncx.OPF)
+			if got := tree(ncx.NavMap); got != tt.want {
+				t.Errorf("NavMap = %s, want %s", got, tt.want)
+			}
+			if got := tree(ncx.Hidden); got != tt.hidden {
+				t.Errorf("Hidden = %s, want %s", got, tt.hidden)
+			}
+			if !reflect.DeepEqual(*ncx.Report, tt.report) {
+				t.Errorf("Report = %+v, want %+v", *ncx.Report, tt.report)
+			}
+		})
+	}
+}
+
+func TestMergeSpineTitle(t *testing.T) {
+	ncx := testBook(t, "a", "b")
+	ncx.NavMap = []*NavPoint{nav("a.xhtml")}
+	ncx.MergeSpine(ncx.OPF)
+	if got := ncx.NavMap[1].Title; got != "B heading" {
+		t.Errorf("title = %q, want %q", got, "B heading")
+	}
+}
+
+func TestCheckOrder(t *testing.T) {
+	spineIndex := map[string]int{"a.xhtml": 0, "b.xhtml": 1, "c.xhtml": 2, "n.xhtml": 3}
+	nonLinear := map[string]bool{"n.xhtml": true}
+	tests := []struct {
+		name   string
+		navs   []*NavPoint
+		report MergeReport
+	}{
+		{
+			name: "in order",
+			navs: []*NavPoint{nav("a.xhtml", nav("a.xhtml#1")), nav("b.xhtml"), nav("c.xhtml")},
+		},
+		{
+			name:   "not in spine",
+			navs:   []*NavPoint{nav("a.xhtml"), nav("x.xhtml"), nav("b.xhtml"), nav("x.xhtml#1")},
+			report: MergeReport{NotInSpine: []string{"x.xhtml"}},
+		},
+		{
+			name:   "out of order",
+			navs:   []*NavPoint{nav("a.xhtml"), nav("c.xhtml"), nav("b.xhtml"), nav("a.xhtml#1")},
+			report: MergeReport{OutOfOrder: []string{"b.xhtml", "a.xhtml"}},
+		},
+		{
+			name: "fragments of the same document",
+			navs: []*NavPoint{nav("b.xhtml"), nav("b.xhtml#2"), nav("b.xhtml#1"), nav("c.xhtml")},
+		},
+		{
+			name: "non-linear documents are anywhere",
+			navs: []*NavPoint{nav("n.xhtml"), nav("a.xhtml"), nav("b.xhtml")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ncx := &NCX{NavMap: tt.navs, Report: &MergeReport{}}
+			ncx.checkOrder(spineIndex, nonLinear)
+			if !reflect.DeepEqual(*ncx.Report, tt.report) {
+				t.Errorf("Report = %+v, want %+v", *ncx.Report, tt.report)
+			}
+		})
+	}
+}
+
+func TestBuildReadingOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		spine []string
+		navs  []*NavPoint
+		split map[string][]*pagePart
+		want  []string
+	}{
+		{
+			name:  "spine order",
+			spine: []string{"a", "b", "c"},
+			navs:  []*NavPoint{nav("c.xhtml"), nav("a.xhtml"), nav("b.xhtml")},
+			want:  []string{"a.html", "b.html", "c.html"},
+		},
+		{
+			name:  "non-linear pages are skipped",
+			spine: []string{"a", "n:no", "b"},
+			navs:  []*NavPoint{nav("a.xhtml"), nav("n.xhtml"), nav("b.xhtml")},
+			want:  []string{"a.html", "b.html"},
+		},
+		{
+			name:  "list pages follow the page before them",
+			spine: []string{"a", "b"},
+			navs:  []*NavPoint{nav("a.xhtml"), nav("list.xhtml"), nav("b.xhtml")},
+			want:  []string{"a.html", "list.html", "b.html"},
+		},
+		{
+			name:  "leading list pages",
+			spine: []string{"a", "b"},
+			navs:  []*NavPoint{nav("list.xhtml"), nav("a.xhtml"), nav("b.xhtml")},
+			want:  []string{"list.html", "a.html", "b.html"},
+		},
+		{
+			name:  "split parts",
+			spine: []string{"a", "b"},
+			navs:  []*NavPoint{nav("a.xhtml"), nav("b.xhtml")},
+			split: map[string][]*pagePart{"a.xhtml": {{Path: "a.html"}, {Path: "a-2.html", Title: "A 2"}, {Path: "a-3.html", Title: "A 3"}}},
+			want:  []string{"a.html", "a-2.html", "a-3.html", "b.html"},
+		},
+		{
+			name:  "split parts in TOC",
+			spine: []string{"a", "b"},
+			navs:  []*NavPoint{nav("a.xhtml"), nav("b.xhtml"), nav("a.xhtml#p2")},
+			split: map[string][]*pagePart{"a.xhtml": {{Path: "a.html"}, {Path: "a-2.html", Title: "A 2"}}},
+			want:  []string{"a.html", "a-2.html", "b.html"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ncx := testBook(t, tt.spine...)
+			// the generated list is in manifest, but not in spine
+			list := &ManifestItem{Id: "epub2website-loi", Href: "list.xhtml", MediaType: MediaTypeHTML}
+			ncx.OPF.Manifests = append(ncx.OPF.Manifests, list)
+			ncx.manifestItems[list.Href] = list
+			ncx.NavMap = tt.navs
+			ncx.buildPagePaths(ncx.OPF)
+			ncx.splitParts = tt.split
+			ncx.splitIds = map[string]map[string]int{"a.xhtml": {"p2": 1}}
+			ncx.UpdateNavMap()
+			ncx.addSplitParts()
+			ncx.buildReadingOrder(ncx.OPF)
+			var got []string
+			for _, np := range ncx.readingOrder {
+				got = append(got, np.Src)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reading order = %v, want %v", got, tt.want)
+			}
+			for i, p := range tt.want {
+				if ncx.readingIndex[p] != i {
+					t.Errorf("readingIndex[%s] = %d, want %d", p, ncx.readingIndex[p], i)
+				}
+			}
+		})
+	}
+}
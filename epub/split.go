@@ -0,0 +1,235 @@
+package epub
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+// values of Options.SplitAt
+const (
+	// SplitH1 starts a page at every h1 heading
+	SplitH1 = "h1"
+	// SplitH2 starts a page at every h1 and h2 heading
+	SplitH2 = "h2"
+	// SplitSize starts a page when the html of the current one exceeds splitSize
+	SplitSize = "size"
+)
+
+// bytes of html in a page split by SplitSize
+const splitSize = 100 * 1024
+
+// pagePart is an output page holding a part of a split content document
+type pagePart struct {
+	Path string
+	// Title is the first heading in the part, may be empty
+	Title string
+}
+
+// markIds sets the generated ids of headings and list targets, every parse of a document gets the same ids
+func (ncx *NCX) markIds(doc *goquery.Document) {
+	ncx.markHeadings(doc)
+	ncx.markListTargets(doc)
+}
+
+// splitPages plans the pages of spine items split by Options.SplitAt, it must be called after buildPagePaths.
+// The first part keeps the page of the document, every id is mapped to the part holding it,
+// so links and TOC entries with fragments go to the right page.
+func (ncx *NCX) splitPages(opf *OPF) {
+	ncx.splitParts = make(map[string][]*pagePart)
+	ncx.splitIds = make(map[string]map[string]int)
+	if ncx.Options.SplitAt == "" {
+		return
+	}
+	planned := make(map[string]bool)
+	for _, item := range opf.Spine.ItemRefs {
+		mf := opf.findRenderable(opf.findManifestItem(item.Idref))
+		if mf == nil || planned[cleanHref(mf.Href)] || ncx.isFixed(ncx.itemRefs[cleanHref(mf.Href)]) {
+			continue
+		}
+		key := cleanHref(mf.Href)
+		planned[key] = true
+		if mf.MediaType != MediaTypeHTML && mf.MediaType != MediaTypeTextHTML {
+			continue
+		}
+		doc, err := ncx.parseDocument(key)
+		if err != nil {
+			continue
+		}
+		ncx.markIds(doc)
+		blocks := splitContainer(doc).Children()
+		starts := ncx.splitStarts(blocks)
+		if len(starts) == 0 {
+			continue
+		}
+		first := ncx.pagePath(key)
+		ext := path.Ext(first)
+		parts := []*pagePart{{Path: first}}
+		for i := range starts {
+			name := fmt.Sprintf("%s-%d%s", strings.TrimSuffix(first, ext), i+2, ext)
+			parts = append(parts, &pagePart{Path: ncx.reservePage(key, name)})
+		}
+		ids := make(map[string]int)
+		blocks.Each(func(i int, s *goquery.Selection) {
+			part := partOfBlock(starts, i)
+			s.Find("[id]").AddSelection(s.Filter("[id]")).Each(func(j int, el *goquery.Selection) {
+				if _, ok := ids[el.AttrOr("id", "")]; !ok {
+					ids[el.AttrOr("id", "")] = part
+				}
+			})
+			if parts[part].Title == "" {
+				parts[part].Title = strings.Join(strings.Fields(s.Find("h1, h2, h3, h4, h5, h6").AddSelection(s.Filter("h1, h2, h3, h4, h5, h6")).First().Text()), " ")
+			}
+		})
+		ncx.splitParts[key] = parts
+		ncx.splitIds[key] = ids
+	}
+}
+
+// splitContainer returns the element whose children are split into pages,
+// wrappers holding nothing but one element are skipped
+func splitContainer(doc *goquery.Document) *goquery.Selection {
+	c := doc.Find("body").First()
+	for {
+		children := c.Children()
+		if children.Length() != 1 || children.Is("h1, h2, h3, h4, h5, h6") {
+			return c
+		}
+		for _, n := range c.Contents().Nodes {
+			if n.Type == html.TextNode && strings.TrimSpace(n.Data) != "" {
+				return c
+			}
+		}
+		c = children
+	}
+}
+
+// splitStarts returns the indexes of the blocks starting a new part, the first part starts at block 0.
+// A block starts a part when it is or contains a heading of Options.SplitAt,
+// headings nested in blocks with content before them are not split points.
+func (ncx *NCX) splitStarts(blocks *goquery.Selection) []int {
+	var starts []int
+	size := 0
+	blocks.Each(func(i int, s *goquery.Selection) {
+		switch ncx.Options.SplitAt {
+		case SplitH1, SplitH2:
+			selector := "h1"
+			if ncx.Options.SplitAt == SplitH2 {
+				selector = "h1, h2"
+			}
+			if i > 0 && (s.Is(selector) || s.Find(selector).Length() > 0) {
+				starts = append(starts, i)
+			}
+		case SplitSize:
+			h, _ := goquery.OuterHtml(s)
+			if size > 0 && size+len(h) > splitSize {
+				starts = append(starts, i)
+				size = 0
+			}
+			size += len(h)
+		}
+	})
+	return starts
+}
+
+// partOfBlock returns the part of block i
+func partOfBlock(starts []int, i int) int {
+	part := 0
+	for part < len(starts) && starts[part] <= i {
+		part++
+	}
+	return part
+}
+
+// partOf returns the part of content document href holding the fragment of ref, like "#id" or "?x#id".
+// It is 0 when the document is not split or the fragment is not found.
+func (ncx *NCX) partOf(href, ref string) int {
+	id := strings.TrimPrefix(fragment(ref), "#")
+	if unescaped, err := url.PathUnescape(id); err == nil {
+		id = unescaped
+	}
+	return ncx.splitIds[cleanHref(href)][id]
+}
+
+// partPath returns the output page of a part of content document href
+func (ncx *NCX) partPath(href string, part int) string {
+	if parts := ncx.splitParts[cleanHref(href)]; part > 0 && part < len(parts) {
+		return parts[part].Path
+	}
+	return ncx.pagePath(href)
+}
+
+// pagePathsOf returns the output pages of content document href, more than one when it is split
+func (ncx *NCX) pagePathsOf(href string) []string {
+	parts := ncx.splitParts[cleanHref(href)]
+	if len(parts) == 0 {
+		return []string{ncx.pagePath(href)}
+	}
+	var paths []string
+	for _, p := range parts {
+		paths = append(paths, p.Path)
+	}
+	return paths
+}
+
+// addSplitParts renders the parts without TOC entries as hidden pages, it must be called after UpdateNavMap
+func (ncx *NCX) addSplitParts() {
+	rendered := make(map[string]bool)
+	for _, np := range ncx.pages() {
+		rendered[np.Src] = true
+	}
+	for _, item := range ncx.OPF.Spine.ItemRefs {
+		mf := ncx.OPF.findRenderable(ncx.OPF.findManifestItem(item.Idref))
+		if mf == nil {
+			continue
+		}
+		parts := ncx.splitParts[cleanHref(mf.Href)]
+		for i, p := range parts {
+			if i == 0 || rendered[p.Path] {
+				continue
+			}
+			title := p.Title
+			if title == "" {
+				title = fmt.Sprintf("%s (%d)", ncx.findSpineTitle(mf, findTitle), i+1)
+			}
+			page := &NavPoint{
+				Title: title,
+				Content: content{
+					Src: mf.Href,
+				},
+				Part: i,
+			}
+			ncx.initNavPoint(page)
+			ncx.Hidden = append(ncx.Hidden, page)
+			rendered[p.Path] = true
+		}
+	}
+}
+
+// selectPart removes the blocks of other parts from doc, which is the whole content document of np
+func (np *NavPoint) selectPart(doc *goquery.Document) {
+	if len(np.NCX.splitParts[cleanHref(np.HtmlPath)]) == 0 {
+		return
+	}
+	container := splitContainer(doc)
+	starts := np.NCX.splitStarts(container.Children())
+	block, part := -1, 0
+	var removed []*html.Node
+	for _, n := range container.Contents().Nodes {
+		// text between blocks goes with the block before it
+		if n.Type == html.ElementNode {
+			block++
+			part = partOfBlock(starts, block)
+		}
+		if part != np.Part {
+			removed = append(removed, n)
+		}
+	}
+	for _, n := range removed {
+		n.Parent.RemoveChild(n)
+	}
+}
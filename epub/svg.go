@@ -0,0 +1,49 @@
+package epub
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// loadSvg inlines a SVG spine item into its page, so images and links inside it work,
+// the SVG is shown as an image when it can not be parsed
+func (np *NavPoint) loadSvg(r io.Reader) (*goquery.Document, error) {
+	src := (&url.URL{Path: path.Base(cleanHref(np.HtmlPath))}).EscapedPath()
+	fallback := fmt.Sprintf(`<div class="epub-image-page"><img src="%s" alt="%s"/></div>`, src, html.EscapeString(np.Title))
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<div class="epub-image-page epub-svg-page"></div>`))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	root, err := parseXML(data)
+	if err == nil {
+		svg := goquery.NewDocumentFromNode(root).Find("svg").First()
+		if svg.Length() > 0 {
+			doc.Find(".epub-svg-page").AppendSelection(svg)
+			return doc, nil
+		}
+		err = fmt.Errorf("svg element not found")
+	}
+	fmt.Fprintf(os.Stderr, "warnning: %s is shown as an image, it can not be inlined: %s\n", np.HtmlPath, err)
+	return goquery.NewDocumentFromReader(strings.NewReader(fallback))
+}
+
+// prepareSvg marks the outermost SVG elements with viewBox, they are scaled to fit the page like images
+func prepareSvg(doc *goquery.Document) {
+	doc.Find("svg").Each(func(i int, s *goquery.Selection) {
+		if _, ok := s.Attr("viewBox"); ok && s.ParentsFiltered("svg").Length() == 0 {
+			s.AddClass("epub-svg")
+		}
+	})
+}
@@ -9,4 +9,6 @@ require (
 	github.com/mholt/archiver/v3 v3.5.1
 	github.com/otiai10/copy v1.4.2
 	github.com/ulikunitz/xz v0.5.9 // indirect
+	golang.org/x/net v0.0.0-20200202094626-16171245cfb2
+	gopkg.in/yaml.v2 v2.4.0
 )
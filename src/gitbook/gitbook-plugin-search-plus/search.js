@@ -59,7 +59,7 @@ require([
       var $title = $('<h3>')
 
       var $link = $('<a>', {
-        'href': gitbook.state.basePath + '/' + item.url + '?h=' + encodeURIComponent(res.query),
+        'href': gitbook.state.basePath + '/' + item.url + '?h=' + encodeURIComponent(res.query) + (item.anchor ? '#' + item.anchor : ''),
         'text': item.title,
         'data-is-search': 1
       })
@@ -87,6 +87,16 @@ require([
     return String(keyword).replace(/([-.*+?^${}()|[\]/\\])/g, '\\$1')
   }
 
+  // the page of print edition where the keyword is found
+  function findPage (store, index) {
+    var found = null
+    if (!store.pages) return found
+    for (var i = 0; i < store.pages.length && store.pages[i].offset <= index; i++) {
+      found = store.pages[i]
+    }
+    return found
+  }
+
   function query (originKeyword) {
     if (originKeyword == null || originKeyword.trim() === '') return
 
@@ -107,9 +117,11 @@ require([
       if (
         hit || ~(index = store.body.toLowerCase().indexOf(keyword))
       ) {
+        var printPage = findPage(store, index)
         results.push({
           url: page,
-          title: store.title,
+          anchor: printPage && printPage.anchor,
+          title: printPage ? store.title + ' (p. ' + printPage.label + ')' : store.title,
           body: store.body.substr(Math.max(0, index - 50), MAX_DESCRIPTION_SIZE)
                 .replace(/^[^\s,.]+./, '').replace(/(..*)[\s,.].*/, '$1') // prevent break word
                 .replace(keywordRe, '<span class="search-highlight-keyword">$1</span>')